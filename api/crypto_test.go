@@ -0,0 +1,218 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// Cifrado de las versiones anteriores: AES-CBC con el IV derivado de la clave
+// al principio y la clave igual al SHA3 de la contraseña
+func encryptCBC(t *testing.T, plaintext, key []byte) []byte {
+	t.Helper()
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := (&CryptoService{}).deriveIVFromKey(key)
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(bytes.Clone(plaintext), bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+	return append(bytes.Clone(iv), ciphertext...)
+}
+
+func legacyKey(password string) []byte {
+	hash := sha3.Sum256([]byte(password))
+	return hash[:]
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	cs := &CryptoService{}
+	key := legacyKey("clave de prueba")
+
+	tests := []struct {
+		name      string
+		plaintext []byte
+	}{
+		{name: "vacío", plaintext: []byte{}},
+		{name: "corto", plaintext: []byte("contraseña SMTP")},
+		{name: "un bloque", plaintext: []byte("0123456789abcdef")},
+		{name: "largo", plaintext: bytes.Repeat([]byte("credencial "), 100)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ciphertext, err := cs.encrypt(tt.plaintext, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ciphertext[0] != cryptoVersionGCM {
+				t.Errorf("versión = %d, se esperaba %d", ciphertext[0], cryptoVersionGCM)
+			}
+			if cs.legacy(ciphertext, key) {
+				t.Error("un texto cifrado con GCM se detectó como CBC")
+			}
+
+			// El nonce es aleatorio: cifrar dos veces da resultados distintos
+			again, err := cs.encrypt(tt.plaintext, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(ciphertext, again) {
+				t.Error("dos cifrados del mismo texto son iguales")
+			}
+
+			plaintext, err := cs.decrypt(ciphertext, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(plaintext, tt.plaintext) {
+				t.Errorf("decrypt = %q, se esperaba %q", plaintext, tt.plaintext)
+			}
+		})
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	cs := &CryptoService{}
+	key := legacyKey("clave de prueba")
+	ciphertext, err := cs.encrypt([]byte("contraseña SMTP"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flip := func(i int) []byte {
+		tampered := bytes.Clone(ciphertext)
+		tampered[i] ^= 0x01
+		return tampered
+	}
+	tests := []struct {
+		name       string
+		ciphertext []byte
+		key        []byte
+	}{
+		{name: "versión", ciphertext: flip(0), key: key},
+		{name: "nonce", ciphertext: flip(1), key: key},
+		{name: "texto cifrado", ciphertext: flip(13), key: key},
+		{name: "etiqueta", ciphertext: flip(len(ciphertext) - 1), key: key},
+		{name: "truncado", ciphertext: ciphertext[:len(ciphertext)-1], key: key},
+		{name: "solo la cabecera", ciphertext: ciphertext[:13], key: key},
+		{name: "otra clave", ciphertext: ciphertext, key: legacyKey("otra clave")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext, err := cs.decrypt(tt.ciphertext, tt.key)
+			if !errors.Is(err, errDecrypt) {
+				t.Errorf("decrypt = %q, %v; se esperaba errDecrypt", plaintext, err)
+			}
+		})
+	}
+}
+
+func TestDecryptCBC(t *testing.T) {
+	cs := &CryptoService{}
+	key := legacyKey("contraseña del usuario")
+
+	tests := []struct {
+		name       string
+		ciphertext []byte
+		want       []byte // nil si debe rechazarse
+	}{
+		{name: "corto", ciphertext: encryptCBC(t, []byte("usuario@email.com"), key), want: []byte("usuario@email.com")},
+		{name: "vacío", ciphertext: encryptCBC(t, []byte{}, key), want: []byte{}},
+		{name: "un bloque", ciphertext: encryptCBC(t, []byte("0123456789abcdef"), key), want: []byte("0123456789abcdef")},
+		{name: "solo el IV", ciphertext: cs.deriveIVFromKey(key)},
+		{name: "sin completar un bloque", ciphertext: encryptCBC(t, []byte("usuario"), key)[:aes.BlockSize+5]},
+		{
+			// Con otra clave el relleno no es válido
+			name:       "relleno inválido",
+			ciphertext: append(cs.deriveIVFromKey(key), encryptCBC(t, []byte("usuario"), legacyKey("otra"))[aes.BlockSize:]...),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !cs.legacy(tt.ciphertext, key) {
+				t.Fatal("no se detectó el formato CBC")
+			}
+
+			plaintext, err := cs.decrypt(tt.ciphertext, key)
+			if tt.want == nil {
+				if !errors.Is(err, errDecrypt) {
+					t.Errorf("decrypt = %q, %v; se esperaba errDecrypt", plaintext, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(plaintext, tt.want) {
+				t.Errorf("decrypt = %q, se esperaba %q", plaintext, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecryptFieldMigratesCBC(t *testing.T) {
+	ah := &AuthHandler{cryptoService: &CryptoService{}}
+	key := legacyKey("contraseña del usuario")
+	gcm, err := ah.cryptoService.encrypt([]byte("contraseña SMTP"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		field     string
+		migrated  bool
+		plaintext string
+	}{
+		{
+			name:      "registro CBC",
+			field:     hex.EncodeToString(encryptCBC(t, []byte("contraseña SMTP"), key)),
+			migrated:  true,
+			plaintext: "contraseña SMTP",
+		},
+		{
+			name:      "registro GCM",
+			field:     hex.EncodeToString(gcm),
+			plaintext: "contraseña SMTP",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			field := tt.field
+			migrated := false
+			plaintext, err := ah.decryptField(&field, key, &migrated)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(plaintext) != tt.plaintext {
+				t.Errorf("decryptField = %q, se esperaba %q", plaintext, tt.plaintext)
+			}
+			if migrated != tt.migrated || (field != tt.field) != tt.migrated {
+				t.Fatalf("migrado = %v, campo reescrito = %v; se esperaba %v", migrated, field != tt.field, tt.migrated)
+			}
+
+			// El campo reescrito queda en GCM y se lee sin volver a migrarse
+			data, err := hex.DecodeString(field)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data[0] != cryptoVersionGCM || ah.cryptoService.legacy(data, key) {
+				t.Error("el campo no quedó en el formato GCM")
+			}
+			migrated = false
+			plaintext, err = ah.decryptField(&field, key, &migrated)
+			if err != nil || migrated || string(plaintext) != tt.plaintext {
+				t.Errorf("segunda lectura = %q, %v, migrado = %v", plaintext, err, migrated)
+			}
+		})
+	}
+}
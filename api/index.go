@@ -5,297 +5,3134 @@ import (
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	mathrand "math/rand/v2"
+	"mime/multipart"
 	"net/http"
-	"net/smtp"
 	"os"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"mailapi/i18n"
+	"mailapi/kms"
+	"mailapi/mailer"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
 	"golang.org/x/crypto/sha3"
 )
 
-// Constants and configuration
-const (
-	smtpServer = "smtp.gmail.com"
-	smtpPort   = "587"
-)
+// Struct definitions
+type EmailRequest struct {
+	FromName string     `json:"fromName,omitempty"`
+	To       Recipients `json:"to"`
+	Cc       Recipients `json:"cc,omitempty"`
+	Bcc      Recipients `json:"bcc,omitempty"`
+	Subject  string     `json:"subject"`
+	HtmlBody string     `json:"htmlBody"`
+	TextBody string     `json:"textBody,omitempty"`
+
+	Attachments []mailer.Attachment `json:"attachments,omitempty"`
+
+	// Respuestas, hilos y cabeceras adicionales (X-*)
+	ReplyTo    Recipients        `json:"replyTo,omitempty"`
+	InReplyTo  string            `json:"inReplyTo,omitempty"`
+	References []string          `json:"references,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+
+	// Plantilla guardada a usar en lugar de htmlBody/textBody
+	TemplateID string         `json:"templateId,omitempty"`
+	Variables  map[string]any `json:"variables,omitempty"`
+
+	// Endurece la política TLS de la credencial solo para este envío
+	TLSPolicy mailer.TLSPolicy `json:"tlsPolicy,omitempty"`
+
+	// Arma el mensaje y lo devuelve sin contactar al servidor SMTP
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// Encola el correo y responde 202; un worker lo envía después
+	Async bool `json:"async,omitempty"`
+}
+
+// Mensaje a enviar a partir de la solicitud (el remitente lo pone EmailService)
+func (r EmailRequest) message() *mailer.Message {
+	return &mailer.Message{
+		FromName: r.FromName,
+		To:       r.To,
+		Cc:       r.Cc,
+		Bcc:      r.Bcc,
+		Subject:  r.Subject,
+		HtmlBody: r.HtmlBody,
+		TextBody: r.TextBody,
+
+		Attachments: r.Attachments,
+
+		ReplyTo:    r.ReplyTo,
+		InReplyTo:  r.InReplyTo,
+		References: r.References,
+		Headers:    r.Headers,
+	}
+}
+
+// Envío masivo: una fila por destinatario y el asunto y el cuerpo como
+// plantilla, donde cada columna de la fila es una variable ({{.nombre}})
+type BulkRequest struct {
+	FromName   string `json:"fromName,omitempty"`
+	Subject    string `json:"subject"`
+	HtmlBody   string `json:"htmlBody"`
+	TextBody   string `json:"textBody,omitempty"`
+	TemplateID string `json:"templateId,omitempty"`
+
+	// Filas en JSON o un CSV con cabecera; el destinatario sale de la columna
+	// "email" salvo que se indique otra
+	Rows        []map[string]any `json:"rows,omitempty"`
+	CSV         string           `json:"csv,omitempty"`
+	EmailColumn string           `json:"emailColumn,omitempty"`
+
+	TLSPolicy mailer.TLSPolicy `json:"tlsPolicy,omitempty"`
+}
+
+func (r BulkRequest) rows() ([]map[string]any, error) {
+	if r.CSV == "" {
+		return r.Rows, nil
+	}
+	if len(r.Rows) > 0 {
+		return nil, &mailer.Error{Code: mailer.CodeInvalidCSV, Message: "usa rows o csv, no ambos"}
+	}
+	return mailer.ReadCSV(strings.NewReader(r.CSV))
+}
+
+func (r BulkRequest) emailColumn() string {
+	if r.EmailColumn == "" {
+		return "email"
+	}
+	return r.EmailColumn
+}
+
+// Límite de filas por solicitud
+const maxBulkRows = 100
+
+// Sin la cola, tiempo para enviar filas dentro de la solicitud, por debajo del
+// límite de duración de las funciones de Vercel (10 s); las filas que no
+// alcancen quedan pendientes en el reporte
+const bulkBudget = 8 * time.Second
+
+// Los reportes de envíos masivos se pueden descargar durante una semana
+const bulkReportTTL = 7 * 24 * time.Hour
+
+// Estados de una fila del envío masivo. Con la cola las filas pasan por los
+// mismos estados que un correo encolado (queued, retrying, sent, failed).
+const (
+	bulkPending = "pending" // no se llegó a enviar dentro del tiempo de la solicitud
+	bulkSent    = statusSent
+	bulkFailed  = statusFailed
+	bulkInvalid = "invalid"
+)
+
+type BulkRowResult struct {
+	Row       int    `json:"row"` // número de fila de datos, sin contar la cabecera
+	Email     string `json:"email"`
+	Status    string `json:"status"`
+	ID        string `json:"id,omitempty"` // correo encolado, para GET /messages/:id
+	MessageID string `json:"messageId,omitempty"`
+	Code      string `json:"code,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func (r *BulkRowResult) fail(status string, err error) {
+	r.Status = status
+	r.Error = err.Error()
+
+	var mailErr *mailer.Error
+	if errors.As(err, &mailErr) {
+		r.Code = mailErr.Code
+	}
+}
+
+// Reporte de un envío masivo. Las filas se guardan aparte, en un hash, para
+// actualizar cada una a medida que se envía.
+type BulkReport struct {
+	ID        string          `json:"id"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Total     int             `json:"total"`
+	Sent      int             `json:"sent"`
+	Failed    int             `json:"failed"`
+	Queued    int             `json:"queued"`  // encoladas o esperando un reintento
+	Pending   int             `json:"pending"` // sin enviar; se pueden volver a mandar
+	Rows      []BulkRowResult `json:"rows"`
+}
+
+// Recalcula los totales a partir de las filas
+func (r *BulkReport) count() {
+	r.Sent, r.Failed, r.Queued, r.Pending = 0, 0, 0, 0
+	for _, row := range r.Rows {
+		switch row.Status {
+		case bulkSent:
+			r.Sent++
+		case bulkFailed:
+			r.Failed++
+		case bulkPending:
+			r.Pending++
+		default:
+			r.Queued++
+		}
+	}
+}
+
+// Lista de destinatarios; acepta un arreglo o, como antes, un solo string
+type Recipients []string
+
+func (r *Recipients) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*r = nil
+		if single != "" {
+			*r = Recipients{single}
+		}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*r = list
+	return nil
+}
+
+type Credential struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+
+	// Servidor SMTP opcional (Gmail si se omite)
+	Host      string           `json:"host,omitempty"`
+	Port      int              `json:"port,omitempty"`
+	Security  mailer.Security  `json:"security,omitempty"`
+	TLSPolicy mailer.TLSPolicy `json:"tlsPolicy,omitempty"`
+
+	// Mecanismo AUTH fijado (PLAIN, LOGIN, CRAM-MD5, XOAUTH2)
+	AuthMechanism mailer.Mechanism `json:"authMechanism,omitempty"`
+
+	// OAuth2 (XOAUTH2) en lugar de contraseña
+	OAuthProvider string `json:"oauthProvider,omitempty"`
+	RefreshToken  string `json:"refreshToken,omitempty"`
+
+	// Idioma del correo de bienvenida y de la respuesta (es, en)
+	Locale string `json:"locale,omitempty"`
+
+	accessToken string             // se obtiene antes de cada envío, nunca se guarda
+	dkim        *mailer.DKIMSigner // firma DKIM de la cuenta, si subió una clave
+}
+
+func (cr Credential) server() mailer.Server {
+	server := mailer.Server{
+		Host:      cr.Host,
+		Port:      cr.Port,
+		Security:  cr.Security,
+		TLSPolicy: cr.TLSPolicy,
+
+		AuthMechanism: cr.AuthMechanism,
+	}
+
+	// Las cuentas OAuth usan por defecto el SMTP de su proveedor
+	if provider, ok := oauthProviders[cr.OAuthProvider]; ok && server.Host == "" {
+		server.Host = provider.Server.Host
+		if server.Port == 0 && server.Security == "" {
+			server.Port = provider.Server.Port
+			server.Security = provider.Server.Security
+		}
+	}
+	return server.WithDefaults()
+}
+
+// Pone en el mensaje el remitente y la firma DKIM de la cuenta
+func (cr Credential) applyTo(msg *mailer.Message) {
+	msg.From = cr.Email
+	msg.DKIM = cr.dkim
+}
+
+func (cr Credential) login() mailer.Login {
+	return mailer.Login{
+		Username:    cr.Email,
+		Password:    cr.Password,
+		AccessToken: cr.accessToken,
+	}
+}
+
+// Datos OAuth que se guardan cifrados junto a la credencial
+type OAuthGrant struct {
+	Provider     string `json:"provider"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// Clave DKIM de la cuenta; la clave privada va en PEM (RSA o Ed25519)
+type DKIMKey struct {
+	Domain     string `json:"domain"`
+	Selector   string `json:"selector"`
+	PrivateKey string `json:"privateKey"`
+}
+
+func (k DKIMKey) signer() (*mailer.DKIMSigner, error) {
+	key, err := mailer.ParseDKIMKey([]byte(k.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	return &mailer.DKIMSigner{Domain: k.Domain, Selector: k.Selector, Key: key}, nil
+}
+
+type EncryptedInfo struct {
+	Key    string `json:"key"`   
+	Value  string `json:"value"`
+	Server string `json:"server,omitempty"`
+	OAuth  string `json:"oauth,omitempty"`
+	DKIM   string `json:"dkim,omitempty"`
+
+	// Clave de datos del registro envuelta con la clave maestra KeyID. Los
+	// registros sin ella se cifran solo con la clave del token.
+	KeyID   string `json:"keyId,omitempty"`
+	DataKey string `json:"dataKey,omitempty"`
+
+	key []byte // clave de los campos, una vez desenvuelta
+}
+
+// Campos cifrados del registro
+func (info *EncryptedInfo) fields() []*string {
+	return []*string{&info.Key, &info.Value, &info.Server, &info.OAuth, &info.DKIM}
+}
+
+// Indica si dos versiones del registro guardan lo mismo
+func (info *EncryptedInfo) sameAs(other EncryptedInfo) bool {
+	return info.Key == other.Key && info.Value == other.Value && info.Server == other.Server &&
+		info.OAuth == other.OAuth && info.DKIM == other.DKIM &&
+		info.KeyID == other.KeyID && info.DataKey == other.DataKey
+}
+
+// Cuenta a la que pertenece un token. El token no se guarda: Redis indexa la
+// clave de API por el hash del token, y cada clave de API guarda la clave de
+// la cuenta cifrada con una clave derivada de su token.
+type Account struct {
+	ID     string
+	token  string
+	key    []byte // clave AES-256 de la cuenta
+	apiKey APIKey // clave de API con la que se autenticó la solicitud
+}
+
+// Permisos de las claves de API
+const (
+	scopeSend           = "send"
+	scopeTemplatesRead  = "templates:read"
+	scopeTemplatesWrite = "templates:write"
+	scopeLogsRead       = "logs:read"
+	scopeAdmin          = "admin"
+)
+
+// Todos los permisos; los tiene la clave creada al registrar la cuenta
+var allScopes = []string{scopeSend, scopeTemplatesRead, scopeTemplatesWrite, scopeLogsRead, scopeAdmin}
+
+// Clave de API de una cuenta. Se listan sin el token, que solo se muestra al
+// crearla.
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	Hint       string     `json:"hint"` // últimos caracteres del token, para reconocerlo
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+
+	// Solo se guardan: el hash del token (para revocarla) y la clave de la
+	// cuenta envuelta con la derivada del token
+	TokenHash  string `json:"tokenHash,omitempty"`
+	WrappedKey string `json:"wrappedKey,omitempty"`
+}
+
+// Solicitud para crear una clave de API
+type APIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+func newAPIKey(name string, scopes []string, token string) APIKey {
+	return APIKey{
+		ID:        newID(),
+		Name:      name,
+		Scopes:    scopes,
+		Hint:      "****" + token[len(token)-6:],
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+func (k APIKey) allows(scope string) bool {
+	return slices.Contains(k.Scopes, scope)
+}
+
+// Copia para responder, sin los datos internos
+func (k APIKey) masked() APIKey {
+	k.TokenHash, k.WrappedKey = "", ""
+	return k
+}
+
+// Registro cifrado de la cuenta
+func accountKey(id string) string {
+	return "account:" + id
+}
+
+// Claves de API de cada cuenta, en un hash indexado por id
+func apiKeysKey(accountID string) string {
+	return "apikeys:" + accountID
+}
+
+func tokenHash(tokenBytes []byte) string {
+	return fmt.Sprintf("%x", sha3.Sum256(tokenBytes))
+}
+
+// Índice hash del token -> "cuenta:clave de API" (solo el id de la cuenta en
+// las cuentas anteriores a las claves de API)
+func tokenIndexKey(hash string) string {
+	return "token:" + hash
+}
+
+// Global variables
+var (
+	ctx = context.Background()
+	redisClient    *redis.Client
+	tlsOptions     mailer.TLSOptions
+	oauthProviders map[string]*mailer.OAuthProvider
+	queueSecret    []byte // cifra los correos encolados; sin ella no hay envío asíncrono
+	cronSecret     string // protege el endpoint que vacía la cola
+	maxAttempts    int    // intentos por correo antes de pasar a la cola de fallidos
+	tokenSecret    []byte // sal de la derivación de claves a partir de los tokens
+	masterKeys     kms.KMS
+)
+
+// Inicialización global de Redis
+func initRedis() *redis.Client {
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		log.Fatal("REDIS_URL no está establecido en las variables de entorno")
+	}
+
+	opt, err := redis.ParseURL(redisURL)
+	if err != nil {
+		log.Fatalf("Error al parsear la URL de Redis: %v", err)
+	}
+
+	return redis.NewClient(opt)
+}
+
+// Opciones TLS para los servidores SMTP (versión mínima y CAs propias)
+func initTLSOptions() mailer.TLSOptions {
+	opts, err := mailer.LoadTLSOptions(os.Getenv("SMTP_TLS_MIN_VERSION"), os.Getenv("SMTP_CA_FILE"))
+	if err != nil {
+		log.Fatalf("Error en la configuración TLS de SMTP: %v", err)
+	}
+	return opts
+}
+
+// Proveedores OAuth2 habilitados según las variables de entorno
+func initOAuthProviders() map[string]*mailer.OAuthProvider {
+	providers := map[string]*mailer.OAuthProvider{}
+
+	if clientID := os.Getenv("GOOGLE_CLIENT_ID"); clientID != "" {
+		providers["google"] = mailer.GoogleOAuth(clientID, os.Getenv("GOOGLE_CLIENT_SECRET"))
+	}
+	if clientID := os.Getenv("MICROSOFT_CLIENT_ID"); clientID != "" {
+		providers["microsoft"] = mailer.MicrosoftOAuth(os.Getenv("MICROSOFT_TENANT"), clientID, os.Getenv("MICROSOFT_CLIENT_SECRET"))
+	}
+
+	return providers
+}
+
+// Clave AES-256 (64 caracteres hexadecimales) para cifrar los correos encolados.
+// Los correos pendientes guardan, cifrada con ella, la clave de la cuenta para
+// que el worker pueda enviarlos sin el token: con un volcado de Redis, QUEUE_KEY
+// y las claves maestras se pueden descifrar las cuentas con correos pendientes.
+// Por eso los correos fallidos no la guardan y caducan con su estado.
+func initQueueSecret() []byte {
+	value := os.Getenv("QUEUE_KEY")
+	if value == "" {
+		return nil
+	}
+
+	key, err := hex.DecodeString(value)
+	if err != nil || len(key) != 32 {
+		log.Fatal("QUEUE_KEY debe tener 64 caracteres hexadecimales (32 bytes)")
+	}
+	return key
+}
+
+// Intentos de envío por correo encolado (QUEUE_MAX_ATTEMPTS, 5 por defecto)
+func initMaxAttempts() int {
+	value := os.Getenv("QUEUE_MAX_ATTEMPTS")
+	if value == "" {
+		return defaultMaxAttempts
+	}
+
+	attempts, err := strconv.Atoi(value)
+	if err != nil || attempts < 1 {
+		log.Fatal("QUEUE_MAX_ATTEMPTS debe ser un entero mayor que cero")
+	}
+	return attempts
+}
+
+// Secreto de la derivación de claves. No se exige para no dejar sin acceso a
+// las cuentas creadas sin él, pero sin él basta el token para descifrarlas.
+func initTokenSecret() []byte {
+	secret := os.Getenv("TOKEN_SECRET")
+	if secret == "" {
+		log.Println("Advertencia: TOKEN_SECRET no está establecido; las claves de cifrado se derivan solo del token")
+	}
+	return []byte(secret)
+}
+
+// Claves maestras para cifrar las claves de datos de las credenciales, desde
+// un archivo (MASTER_KEY_FILE) o en línea (MASTER_KEYS); ver kms.Keyring
+func initMasterKeys() kms.KMS {
+	var keyring *kms.Keyring
+	var err error
+	if path := os.Getenv("MASTER_KEY_FILE"); path != "" {
+		keyring, err = kms.LoadKeyring(path)
+	} else if value := os.Getenv("MASTER_KEYS"); value != "" {
+		keyring, err = kms.ParseKeyring([]byte(value))
+	} else {
+		return nil
+	}
+
+	if err != nil {
+		log.Fatalf("Error en las claves maestras: %v", err)
+	}
+	return keyring
+}
+
+// Inicialización una vez al cargar el módulo
+var setupOnce sync.Once
+
+// Configuración a partir de las variables de entorno. La hace Handler en la
+// primera solicitud y no init, para que el paquete se pueda cargar sin ellas.
+func setup() {
+	redisClient = initRedis()
+	tlsOptions = initTLSOptions()
+	oauthProviders = initOAuthProviders()
+	queueSecret = initQueueSecret()
+	cronSecret = os.Getenv("CRON_SECRET")
+	maxAttempts = initMaxAttempts()
+	tokenSecret = initTokenSecret()
+	masterKeys = initMasterKeys()
+}
+
+// Email Service
+type EmailService struct {
+	// Crea el transporte para la cuenta que envía
+	newTransport func(server mailer.Server, login mailer.Login) mailer.Transport
+}
+
+func (es *EmailService) send(ctx context.Context, cred Credential, msg *mailer.Message) (mailer.Result, error) {
+	cred.applyTo(msg)
+
+	result, err := es.newTransport(cred.server(), cred.login()).Send(ctx, msg)
+
+	// Los errores sin código (conexión, respuestas SMTP) se reportan como send_failed
+	var mailErr *mailer.Error
+	if err != nil && !errors.As(err, &mailErr) {
+		err = &apiError{Code: "send_failed", Err: err}
+	}
+	return result, err
+}
+
+// Arma el mensaje exactamente como se enviaría, sin contactar al servidor
+func (es *EmailService) render(cred Credential, msg *mailer.Message) ([]byte, error) {
+	cred.applyTo(msg)
+
+	return msg.Bytes()
+}
+
+// Renueva el access token OAuth2 antes de enviar. Si el proveedor rota el
+// refresh token, cred queda con el nuevo para que se vuelva a guardar.
+func (es *EmailService) refreshAccessToken(sendCtx context.Context, cred *Credential) error {
+	if cred.RefreshToken == "" {
+		return nil
+	}
+
+	provider, ok := oauthProviders[cred.OAuthProvider]
+	if !ok {
+		return &mailer.Error{Code: mailer.CodeOAuthRefresh, Message: "proveedor OAuth no configurado: " + cred.OAuthProvider}
+	}
+
+	token, err := provider.Refresh(sendCtx, cred.RefreshToken)
+	if err != nil {
+		return err
+	}
+
+	cred.accessToken = token.AccessToken
+	if token.RefreshToken != "" {
+		cred.RefreshToken = token.RefreshToken
+	}
+	return nil
+}
+
+func (es *EmailService) sendWelcomeEmail(cred Credential, token string, lang i18n.Lang) error {
+	subject := i18n.T(lang, "welcome_subject")
+	htmlBody := i18n.T(lang, "welcome_body", token)
+
+	msg := &mailer.Message{
+		To:       []string{cred.Email},
+		Subject:  subject,
+		HtmlBody: htmlBody,
+	}
+
+	if _, err := es.send(ctx, cred, msg); err != nil {
+		log.Println("Error enviando el correo de prueba para verificacion:", err)
+		return &apiError{Code: "invalid_credentials"}
+	}
+
+	return nil
+}
+
+// Crypto Service
+//
+// Los datos se cifran con AES-GCM y un nonce aleatorio:
+//
+//	versión (1 byte) | nonce (12 bytes) | texto cifrado + etiqueta
+//
+// Los registros antiguos usan AES-CBC con un IV derivado de la clave, que va
+// al principio del texto cifrado; se siguen pudiendo leer y se migran al
+// formato nuevo la próxima vez que se desencriptan (ver decryptField).
+type CryptoService struct{}
+
+const cryptoVersionGCM byte = 1
+
+var errDecrypt = errors.New("los datos cifrados son inválidos o fueron alterados")
+
+// Clave de cifrado de una cuenta: HKDF-SHA256 del token con TOKEN_SECRET
+// como sal, para que el token solo no alcance para descifrar lo guardado
+func (cs *CryptoService) deriveKey(tokenBytes []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, tokenBytes, tokenSecret, "mailapi credential", 32)
+}
+
+// Clave de los campos de un registro con clave de datos: hacen falta la clave
+// de datos (que solo se desenvuelve con la clave maestra) y la del token
+func (cs *CryptoService) combineKeys(dataKey, tokenKey []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, dataKey, tokenKey, "mailapi record", 32)
+}
+
+func (cs *CryptoService) deriveIVFromKey(key []byte) []byte {
+	hash := sha3.New256()
+	hash.Write(key)
+	return hash.Sum(nil)[:aes.BlockSize]
+}
+
+func (cs *CryptoService) encrypt(plaintext []byte, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 1+gcm.NonceSize(), 1+gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	out[0] = cryptoVersionGCM
+	if _, err := rand.Read(out[1:]); err != nil {
+		return nil, err
+	}
+
+	// La versión va como dato autenticado para que no se pueda cambiar
+	return gcm.Seal(out, out[1:], plaintext, out[:1]), nil
+}
+
+func (cs *CryptoService) decrypt(ciphertext []byte, key []byte) ([]byte, error) {
+	if cs.legacy(ciphertext, key) {
+		return cs.decryptCBC(ciphertext, key)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < 1+gcm.NonceSize()+gcm.Overhead() || ciphertext[0] != cryptoVersionGCM {
+		return nil, errDecrypt
+	}
+	nonce, sealed := ciphertext[1:1+gcm.NonceSize()], ciphertext[1+gcm.NonceSize():]
+
+	plaintext, err := gcm.Open(nil, nonce, sealed, ciphertext[:1])
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return plaintext, nil
+}
+
+// Indica si el texto cifrado está en el formato antiguo (CBC), que empieza
+// con el IV derivado de la clave
+func (cs *CryptoService) legacy(ciphertext []byte, key []byte) bool {
+	return bytes.HasPrefix(ciphertext, cs.deriveIVFromKey(key))
+}
+
+// Formato antiguo, solo para leer registros que aún no se migraron. CBC no
+// detecta alteraciones; al menos se valida el relleno.
+func (cs *CryptoService) decryptCBC(ciphertext []byte, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := cs.deriveIVFromKey(key)
+	ciphertext = ciphertext[aes.BlockSize:]
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, errDecrypt
+	}
+
+	cbc := cipher.NewCBCDecrypter(block, iv)
+	plaintext := make([]byte, len(ciphertext))
+	cbc.CryptBlocks(plaintext, ciphertext)
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize ||
+		!bytes.Equal(plaintext[len(plaintext)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, errDecrypt
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+// Redis Service
+type RedisService struct{}
+
+func (rs *RedisService) saveObject(client *redis.Client, key string, obj interface{}) error {
+	return rs.saveObjectFor(client, key, obj, 0)
+}
+
+// Igual que saveObject, pero la clave expira pasado ttl
+func (rs *RedisService) saveObjectFor(client *redis.Client, key string, obj interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("error al serializar el objeto: %v", err)
+	}
+
+	return client.Set(ctx, key, data, ttl).Err()
+}
+
+// Error de las lecturas de Redis cuando la clave o el campo no existen
+var errNotFound = errors.New("no encontrado")
+
+func (rs *RedisService) getObject(client *redis.Client, key string, obj interface{}) error {
+	data, err := client.Get(ctx, key).Result()
+	if err != nil {
+		return fmt.Errorf("error al obtener el valor de Redis: %w", err)
+	}
+	return json.Unmarshal([]byte(data), obj)
+}
+
+func (rs *RedisService) exists(client *redis.Client, key string) (bool, error) {
+	n, err := client.Exists(ctx, key).Result()
+	return n > 0, err
+}
+
+// Guarda un objeto en un campo de un hash
+func (rs *RedisService) saveField(client *redis.Client, key, field string, obj interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("error al serializar el objeto: %v", err)
+	}
+
+	return client.HSet(ctx, key, field, data).Err()
+}
+
+func (rs *RedisService) getField(client *redis.Client, key, field string, obj interface{}) error {
+	data, err := client.HGet(ctx, key, field).Result()
+	if err == redis.Nil {
+		return errNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("error al obtener el valor de Redis: %v", err)
+	}
+	return json.Unmarshal([]byte(data), obj)
+}
+
+// Devuelve todos los campos de un hash sin deserializar
+func (rs *RedisService) getFields(client *redis.Client, key string) (map[string]string, error) {
+	fields, err := client.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error al obtener el valor de Redis: %v", err)
+	}
+	return fields, nil
+}
+
+// Renombra una clave conservando su TTL; si no existe no hace nada
+func (rs *RedisService) rename(client *redis.Client, from, to string) error {
+	exists, err := rs.exists(client, from)
+	if err != nil || !exists {
+		return err
+	}
+	if err := client.Rename(ctx, from, to).Err(); err != nil {
+		return fmt.Errorf("error al renombrar la clave en Redis: %v", err)
+	}
+	return nil
+}
+
+func (rs *RedisService) deleteField(client *redis.Client, key, field string) error {
+	n, err := client.HDel(ctx, key, field).Result()
+	if err != nil {
+		return fmt.Errorf("error al eliminar el valor de Redis: %v", err)
+	}
+	if n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// Handlers
+type AuthHandler struct {
+	emailService  *EmailService
+	cryptoService *CryptoService
+	redisService  *RedisService
+	client        *redis.Client
+}
+
+func (ah *AuthHandler) saveCredentials(c *gin.Context) {
+	var newCredential Credential
+	if err := c.BindJSON(&newCredential); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	if locale, ok := i18n.Parse(newCredential.Locale); ok {
+		c.Set(langKey, locale)
+	}
+
+	if newCredential.Password == "" && newCredential.RefreshToken == "" {
+		respondError(c, http.StatusBadRequest, "password_required")
+		return
+	}
+
+	if newCredential.RefreshToken != "" {
+		if _, ok := oauthProviders[newCredential.OAuthProvider]; !ok {
+			respondError(c, http.StatusBadRequest, "oauth_provider_unsupported")
+			return
+		}
+	}
+
+	if err := newCredential.server().Validate(); err != nil {
+		sendError(c, http.StatusBadRequest, &apiError{Code: "invalid_smtp_server", Err: err})
+		return
+	}
+
+	// Generar un token aleatorio, independiente de la contraseña
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		respondError(c, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	token := hex.EncodeToString(tokenBytes)
+
+	// La clave de la cuenta es aleatoria; cada clave de API la guarda envuelta
+	account := Account{ID: newID(), token: token, key: make([]byte, 32)}
+	if _, err := rand.Read(account.key); err != nil {
+		respondError(c, http.StatusInternalServerError, "internal_error")
+		return
+	}
+
+	// Obtener access token para las cuentas OAuth
+	if err := ah.emailService.refreshAccessToken(ctx, &newCredential); err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Enviar correo de prueba
+	if err := ah.emailService.sendWelcomeEmail(newCredential, token, lang(c)); err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Encriptar credenciales
+	var newInfoData EncryptedInfo
+	if err := ah.newRecordKey(account, &newInfoData); err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	encryptedPassword, err := ah.cryptoService.encrypt([]byte(newCredential.Password), newInfoData.key)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "encryption_failed")
+		return
+	}
+
+	encryptedEmail, err := ah.cryptoService.encrypt([]byte(newCredential.Email), newInfoData.key)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "encryption_failed")
+		return
+	}
+
+	serverData, err := json.Marshal(newCredential.server())
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "internal_error")
+		return
+	}
+
+	encryptedServer, err := ah.cryptoService.encrypt(serverData, newInfoData.key)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "encryption_failed")
+		return
+	}
+
+	// Guardar en Redis
+	newInfoData.Key = fmt.Sprintf("%x", encryptedPassword)
+	newInfoData.Value = fmt.Sprintf("%x", encryptedEmail)
+	newInfoData.Server = fmt.Sprintf("%x", encryptedServer)
+
+	if newCredential.RefreshToken != "" {
+		grant := OAuthGrant{Provider: newCredential.OAuthProvider, RefreshToken: newCredential.RefreshToken}
+		encryptedGrant, err := ah.encryptGrant(grant, newInfoData.key)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, "encryption_failed")
+			return
+		}
+		newInfoData.OAuth = encryptedGrant
+	}
+
+	if err := ah.redisService.saveObject(ah.client, accountKey(account.ID), newInfoData); err != nil {
+		sendError(c, http.StatusInternalServerError, &apiError{Code: "storage_error", Err: err})
+		return
+	}
+	apiKey := newAPIKey("default", allScopes, token)
+	if err := ah.saveAPIKey(account, &apiKey, tokenBytes); err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"token":   token,
+		"message": i18n.T(lang(c), "token_created"),
+	})
+}
+
+// Guarda la clave DKIM de la cuenta; desde entonces todos sus correos salen
+// firmados. Responde el registro TXT que hay que publicar en el DNS.
+func (ah *AuthHandler) saveDKIMKey(c *gin.Context) {
+	account := currentAccount(c)
+
+	var key DKIMKey
+	if err := c.ShouldBindJSON(&key); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	credential, _, err := ah.loadCredential(account)
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	// El dominio firmante debe ser el del remitente o uno superior, sin pasar
+	// del dominio organizacional (alineación DMARC)
+	_, emailDomain, _ := strings.Cut(credential.Email, "@")
+	if key.Domain == "" {
+		key.Domain = emailDomain
+	}
+	key.Domain = strings.ToLower(key.Domain)
+	if !mailer.DomainAligned(key.Domain, emailDomain) {
+		respondError(c, http.StatusBadRequest, "dkim_domain_mismatch")
+		return
+	}
+
+	// Se firma y verifica un mensaje de prueba antes de guardar la clave
+	signer, err := key.signer()
+	if err == nil {
+		err = signer.Check()
+	}
+	if err != nil {
+		sendError(c, http.StatusBadRequest, &apiError{Code: "invalid_dkim_key", Err: err})
+		return
+	}
+
+	record, err := signer.DNSRecord()
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	keyData, err := json.Marshal(key)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "internal_error")
+		return
+	}
+
+	err = ah.updateRecord(account, func(info *EncryptedInfo) error {
+		encryptedKey, err := ah.cryptoService.encrypt(keyData, info.key)
+		if err != nil {
+			return &apiError{Code: "encryption_failed", Err: err}
+		}
+		info.DKIM = fmt.Sprintf("%x", encryptedKey)
+		return nil
+	})
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": i18n.T(lang(c), "dkim_saved"),
+		"dns": gin.H{
+			"name":  key.Selector + "._domainkey." + key.Domain,
+			"type":  "TXT",
+			"value": record,
+		},
+	})
+}
+
+// Claves de API de la cuenta, sin los tokens
+func (ah *AuthHandler) listAPIKeys(c *gin.Context) {
+	account := currentAccount(c)
+
+	fields, err := ah.redisService.getFields(ah.client, apiKeysKey(account.ID))
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, &apiError{Code: "storage_error", Err: err})
+		return
+	}
+
+	keys := []APIKey{}
+	for _, data := range fields {
+		var key APIKey
+		if err := json.Unmarshal([]byte(data), &key); err != nil {
+			continue
+		}
+		keys = append(keys, key.masked())
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	c.JSON(http.StatusOK, keys)
+}
+
+// Crea una clave de API. El token solo se muestra en esta respuesta.
+func (ah *AuthHandler) createAPIKey(c *gin.Context) {
+	account := currentAccount(c)
+
+	var request APIKeyRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" {
+		respondError(c, http.StatusBadRequest, "api_key_name_required")
+		return
+	}
+
+	var scopes []string
+	for _, scope := range request.Scopes {
+		if !slices.Contains(allScopes, scope) {
+			respondError(c, http.StatusBadRequest, "invalid_scopes")
+			return
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		respondError(c, http.StatusBadRequest, "invalid_scopes")
+		return
+	}
+
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		respondError(c, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	token := hex.EncodeToString(tokenBytes)
+
+	key := newAPIKey(request.Name, scopes, token)
+	if err := ah.saveAPIKey(account, &key, tokenBytes); err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": i18n.T(lang(c), "api_key_created"),
+		"token":   token,
+		"key":     key.masked(),
+	})
+}
+
+// Revoca una clave de API: su token deja de funcionar al instante
+func (ah *AuthHandler) revokeAPIKey(c *gin.Context) {
+	account := currentAccount(c)
+
+	if err := ah.deleteAPIKey(account.ID, c.Param("id")); err != nil {
+		var apiErr *apiError
+		status := http.StatusInternalServerError
+		if errors.As(err, &apiErr) {
+			switch apiErr.Code {
+			case "api_key_not_found":
+				status = http.StatusNotFound
+			case "last_admin_key":
+				status = http.StatusConflict
+			}
+		}
+		sendError(c, status, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": i18n.T(lang(c), "api_key_revoked")})
+}
+
+// Borra la clave de API y el índice de su token. Se lee y se borra con WATCH
+// sobre las claves de la cuenta para que dos revocaciones simultáneas no la
+// dejen sin ninguna clave admin.
+func (ah *AuthHandler) deleteAPIKey(accountID, id string) error {
+	key := apiKeysKey(accountID)
+	for range maxWatchAttempts {
+		err := ah.client.Watch(ctx, func(tx *redis.Tx) error {
+			fields, err := tx.HGetAll(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			data, ok := fields[id]
+			if !ok {
+				return &apiError{Code: "api_key_not_found"}
+			}
+			var apiKey APIKey
+			if err := json.Unmarshal([]byte(data), &apiKey); err != nil {
+				return err
+			}
+
+			// Sin ninguna clave admin la cuenta ya no podría gestionar sus claves
+			if apiKey.allows(scopeAdmin) {
+				admins := 0
+				for _, data := range fields {
+					var other APIKey
+					if json.Unmarshal([]byte(data), &other) == nil && other.allows(scopeAdmin) {
+						admins++
+					}
+				}
+				if admins <= 1 {
+					return &apiError{Code: "last_admin_key"}
+				}
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Del(ctx, tokenIndexKey(apiKey.TokenHash))
+				pipe.HDel(ctx, key, id)
+				return nil
+			})
+			return err
+		}, key)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+
+		var apiErr *apiError
+		if err != nil && !errors.As(err, &apiErr) {
+			err = &apiError{Code: "storage_error", Err: err}
+		}
+		return err
+	}
+	return &apiError{Code: "storage_error", Err: errWatchConflict}
+}
+
+func (ah *AuthHandler) sendEmailHandler(c *gin.Context) {
+	account := currentAccount(c)
+
+	// Parsear la solicitud
+	var request EmailRequest
+	if err := bindEmailRequest(c, &request); err != nil {
+		var mailErr *mailer.Error
+		if errors.As(err, &mailErr) {
+			sendError(c, http.StatusBadRequest, err)
+			return
+		}
+		respondError(c, http.StatusBadRequest, "invalid_body")
+		return
+	}
+
+	if err := request.TLSPolicy.Validate(); err != nil {
+		sendError(c, http.StatusBadRequest, &apiError{Code: "invalid_tls_policy", Err: err})
+		return
+	}
+
+	if request.TemplateID != "" {
+		if err := ah.applyTemplate(account.ID, &request); err != nil {
+			sendTemplateError(c, err)
+			return
+		}
+	}
+
+	// Validar direcciones, cabeceras y adjuntos antes de tocar las credenciales
+	msg := request.message()
+	if err := msg.Validate(); err != nil {
+		sendError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	// En modo simulación basta con la credencial: no hace falta renovar el
+	// access token porque no se contacta al servidor
+	if request.DryRun {
+		credential, _, err := ah.loadCredential(account)
+		if err != nil {
+			sendError(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		raw, err := ah.emailService.render(credential, msg)
+		if err != nil {
+			sendError(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":   i18n.T(lang(c), "dry_run"),
+			"dryRun":    true,
+			"messageId": msg.MessageID,
+			"envelope":  msg.Envelope(),
+			"raw":       string(raw),
+		})
+		return
+	}
+
+	if request.Async {
+		if queueSecret == nil {
+			respondError(c, http.StatusServiceUnavailable, "async_unavailable")
+			return
+		}
+
+		// Cargar la credencial valida el token antes de aceptar el correo
+		credential, _, err := ah.loadCredential(account)
+		if err != nil {
+			sendError(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		status, err := ah.enqueueEmail(account, credential, request)
+		if err != nil {
+			sendError(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"message":   i18n.T(lang(c), "email_queued"),
+			"id":        status.ID,
+			"messageId": status.MessageID,
+			"status":    status.Status,
+		})
+		return
+	}
+
+	// Obtener la credencial lista para enviar
+	credential, err := ah.prepareCredential(ctx, account, request.TLSPolicy)
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Enviar correo
+	result, err := ah.emailService.send(ctx, credential, msg)
+	if err != nil && temporaryFailure(err) {
+		// Con la cola habilitada el correo no se pierde: se reintenta en segundo plano
+		if queueSecret == nil || maxAttempts < 2 {
+			sendError(c, http.StatusServiceUnavailable, err)
+			return
+		}
+
+		status, retryErr := ah.retryLater(account, msg, request, result, err)
+		if retryErr != nil {
+			sendError(c, http.StatusInternalServerError, retryErr)
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"message":       i18n.T(lang(c), "email_retrying"),
+			"id":            status.ID,
+			"messageId":     status.MessageID,
+			"status":        status.Status,
+			"nextAttemptAt": status.NextAttemptAt,
+			"code":          status.Code,
+			"detail":        status.Error,
+		})
+		return
+	}
+	if err != nil {
+		var mailErr *mailer.Error
+		if errors.As(err, &mailErr) && mailErr.Code == mailer.CodeRecipientsRejected {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":      i18n.T(lang(c), mailErr.Code),
+				"code":       mailErr.Code,
+				"detail":     mailErr.Error(),
+				"recipients": result.Recipients,
+			})
+			return
+		}
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	// El servidor aceptó el correo pero difirió a algunos destinatarios: con la
+	// cola habilitada se les reintenta en segundo plano
+	if deferred := result.DeferredError(); deferred != nil {
+		if queueSecret != nil && maxAttempts >= 2 {
+			status, err := ah.retryLater(account, msg, request, result, deferred)
+			if err == nil {
+				c.JSON(http.StatusAccepted, gin.H{
+					"message":       i18n.T(lang(c), "email_partially_sent"),
+					"id":            status.ID,
+					"messageId":     status.MessageID,
+					"status":        status.Status,
+					"nextAttemptAt": status.NextAttemptAt,
+					"code":          status.Code,
+					"detail":        status.Error,
+					"recipients":    result.Recipients,
+				})
+				return
+			}
+			log.Println("Error encolando a los destinatarios diferidos:", err)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":    i18n.T(lang(c), "email_sent"),
+			"messageId":  result.MessageID,
+			"code":       mailer.CodeRecipientsDeferred,
+			"detail":     deferred.Error(),
+			"recipients": result.Recipients,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    i18n.T(lang(c), "email_sent"),
+		"messageId":  result.MessageID,
+		"recipients": result.Recipients,
+	})
+}
+
+// Envía un correo personalizado por fila. Todas las filas se validan y
+// renderizan antes de enviar: si alguna falla no se envía ninguna. Con la cola
+// habilitada las filas se encolan y el reporte se completa a medida que el
+// worker las envía; sin ella se envían las que quepan en bulkBudget.
+func (ah *AuthHandler) sendBulkHandler(c *gin.Context) {
+	account := currentAccount(c)
+
+	var request BulkRequest
+	if err := bindBulkRequest(c, &request); err != nil {
+		var mailErr *mailer.Error
+		if errors.As(err, &mailErr) {
+			sendError(c, http.StatusBadRequest, err)
+			return
+		}
+		respondError(c, http.StatusBadRequest, "invalid_body")
+		return
+	}
+
+	if err := request.TLSPolicy.Validate(); err != nil {
+		sendError(c, http.StatusBadRequest, &apiError{Code: "invalid_tls_policy", Err: err})
+		return
+	}
+
+	rows, err := request.rows()
+	if err != nil {
+		sendError(c, http.StatusBadRequest, err)
+		return
+	}
+	if len(rows) == 0 {
+		respondError(c, http.StatusBadRequest, "no_rows")
+		return
+	}
+	if len(rows) > maxBulkRows {
+		respondError(c, http.StatusBadRequest, "too_many_rows", maxBulkRows)
+		return
+	}
+
+	// El contenido viene de la solicitud o de una plantilla guardada
+	tmpl := mailer.Template{Subject: request.Subject, HtmlBody: request.HtmlBody, TextBody: request.TextBody}
+	if request.TemplateID != "" {
+		if request.HtmlBody != "" || request.TextBody != "" {
+			sendError(c, http.StatusBadRequest, &mailer.Error{Code: mailer.CodeInvalidTemplate, Message: "templateId no se puede combinar con htmlBody ni textBody"})
+			return
+		}
+
+		tmpl, err = ah.getTemplate(account.ID, request.TemplateID)
+		if err != nil {
+			sendTemplateError(c, err)
+			return
+		}
+		if request.Subject != "" {
+			tmpl.Subject = request.Subject
+		}
+	} else if tmpl.HtmlBody == "" && tmpl.TextBody == "" {
+		respondError(c, http.StatusBadRequest, "body_required")
+		return
+	}
+
+	// Renderizar y validar todas las filas antes de enviar
+	column := request.emailColumn()
+	messages := make([]*mailer.Message, len(rows))
+	var invalid []BulkRowResult
+	for i, row := range rows {
+		email, _ := row[column].(string)
+		result := BulkRowResult{Row: i + 1, Email: email}
+
+		rendered, err := tmpl.Render(row)
+		if err == nil {
+			messages[i] = &mailer.Message{
+				FromName: request.FromName,
+				To:       []string{email},
+				Subject:  rendered.Subject,
+				HtmlBody: rendered.HtmlBody,
+				TextBody: rendered.TextBody,
+			}
+			if email == "" {
+				err = &mailer.Error{Code: mailer.CodeNoRecipients, Message: "la fila no tiene valor en la columna " + column}
+			} else {
+				err = messages[i].Validate()
+			}
+		}
+
+		if err != nil {
+			// Una plantilla que no compila falla igual en todas las filas
+			var mailErr *mailer.Error
+			if errors.As(err, &mailErr) && mailErr.Code == mailer.CodeInvalidTemplate {
+				sendError(c, http.StatusBadRequest, err)
+				return
+			}
+			result.fail(bulkInvalid, err)
+			invalid = append(invalid, result)
+		}
+	}
+
+	if len(invalid) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": i18n.T(lang(c), "invalid_rows"), "code": "invalid_rows", "rows": invalid})
+		return
+	}
+
+	report := BulkReport{ID: newID(), CreatedAt: time.Now().UTC(), Total: len(messages)}
+	if queueSecret != nil {
+		ah.enqueueBulk(c, account, request, &report, messages)
+		return
+	}
+
+	// El plazo incluye renovar el access token OAuth
+	sendCtx, cancel := context.WithTimeout(ctx, bulkBudget)
+	defer cancel()
+
+	credential, err := ah.prepareCredential(sendCtx, account, request.TLSPolicy)
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Todas las filas quedan pendientes antes de empezar, de modo que si la
+	// función se corta el reporte indica cuáles faltan
+	for i, msg := range messages {
+		report.Rows = append(report.Rows, BulkRowResult{Row: i + 1, Email: msg.To[0], Status: bulkPending})
+	}
+	if err := ah.saveBulkReport(account.ID, report); err != nil {
+		sendError(c, http.StatusInternalServerError, &apiError{Code: "storage_error", Err: err})
+		return
+	}
+
+	// Enviar un correo por fila; un fallo no detiene al resto
+	for i, msg := range messages {
+		if sendCtx.Err() != nil {
+			break
+		}
+
+		result := &report.Rows[i]
+		sent, err := ah.emailService.send(sendCtx, credential, msg)
+		if err != nil {
+			result.fail(bulkFailed, err)
+		} else {
+			result.Status = bulkSent
+			result.MessageID = sent.MessageID
+		}
+
+		if err := ah.saveBulkRows(account.ID, report.ID, *result); err != nil {
+			log.Println("Error guardando el reporte del envío masivo:", err)
+		}
+	}
+
+	report.count()
+	writeBulkReport(c, http.StatusOK, report)
+}
+
+// Encola un correo por fila y responde 202 con el reporte
+func (ah *AuthHandler) enqueueBulk(c *gin.Context, account Account, request BulkRequest, report *BulkReport, messages []*mailer.Message) {
+	credential, _, err := ah.loadCredential(account)
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := ah.saveBulkReport(account.ID, *report); err != nil {
+		sendError(c, http.StatusInternalServerError, &apiError{Code: "storage_error", Err: err})
+		return
+	}
+
+	for i, msg := range messages {
+		job := QueuedEmail{
+			ID:        newID(),
+			MessageID: mailer.NewMessageID(credential.Email),
+			Request: EmailRequest{
+				FromName:  msg.FromName,
+				To:        msg.To,
+				Subject:   msg.Subject,
+				HtmlBody:  msg.HtmlBody,
+				TextBody:  msg.TextBody,
+				TLSPolicy: request.TLSPolicy,
+			},
+			QueuedAt: time.Now().UTC(),
+			BulkID:   report.ID,
+			Row:      i + 1,
+		}
+		job.setAccount(account)
+		status := MessageStatus{ID: job.ID, MessageID: job.MessageID, Status: statusQueued, QueuedAt: job.QueuedAt}
+
+		row := BulkRowResult{Row: job.Row, Email: msg.To[0], Status: statusQueued, ID: job.ID, MessageID: job.MessageID}
+		if err := ah.pushJob(account, job, status); err != nil {
+			row.fail(bulkFailed, err)
+			if err := ah.saveBulkRows(account.ID, report.ID, row); err != nil {
+				log.Println("Error guardando el reporte del envío masivo:", err)
+			}
+		}
+		report.Rows = append(report.Rows, row)
+	}
+
+	report.count()
+	writeBulkReport(c, http.StatusAccepted, *report)
+}
+
+// Descarga el reporte de un envío masivo (JSON, o CSV con ?format=csv)
+func (ah *AuthHandler) bulkReportHandler(c *gin.Context) {
+	account := currentAccount(c)
+
+	var report BulkReport
+	if err := ah.redisService.getObject(ah.client, bulkReportKey(account.ID, c.Param("id")), &report); err != nil {
+		if errors.Is(err, redis.Nil) {
+			respondError(c, http.StatusNotFound, "report_not_found")
+			return
+		}
+		sendError(c, http.StatusInternalServerError, &apiError{Code: "storage_error", Err: err})
+		return
+	}
+
+	// Los reportes anteriores guardaban las filas junto con el resto
+	rows, err := ah.redisService.getFields(ah.client, bulkRowsKey(account.ID, report.ID))
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, &apiError{Code: "storage_error", Err: err})
+		return
+	}
+	if len(rows) > 0 {
+		report.Rows = report.Rows[:0]
+		for _, data := range rows {
+			var row BulkRowResult
+			if err := json.Unmarshal([]byte(data), &row); err != nil {
+				continue
+			}
+			report.Rows = append(report.Rows, row)
+		}
+		sort.Slice(report.Rows, func(i, j int) bool { return report.Rows[i].Row < report.Rows[j].Row })
+	}
+
+	report.count()
+	writeBulkReport(c, http.StatusOK, report)
+}
+
+func bulkReportKey(accountID, id string) string {
+	return "bulk:" + accountID + ":" + id
+}
+
+// Filas del reporte, en un hash indexado por número de fila
+func bulkRowsKey(accountID, id string) string {
+	return bulkReportKey(accountID, id) + ":rows"
+}
+
+// Guarda el reporte sin las filas y, si ya tiene, las filas
+func (ah *AuthHandler) saveBulkReport(accountID string, report BulkReport) error {
+	rows := report.Rows
+	report.Rows = nil
+	if err := ah.redisService.saveObjectFor(ah.client, bulkReportKey(accountID, report.ID), report, bulkReportTTL); err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return ah.saveBulkRows(accountID, report.ID, rows...)
+}
+
+// Guarda filas del reporte. Cada actualización renueva la expiración del
+// reporte completo.
+func (ah *AuthHandler) saveBulkRows(accountID, id string, rows ...BulkRowResult) error {
+	values := make([]any, 0, 2*len(rows))
+	for _, row := range rows {
+		data, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		values = append(values, strconv.Itoa(row.Row), data)
+	}
+
+	_, err := ah.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, bulkRowsKey(accountID, id), values...)
+		pipe.Expire(ctx, bulkRowsKey(accountID, id), bulkReportTTL)
+		pipe.Expire(ctx, bulkReportKey(accountID, id), bulkReportTTL)
+		return nil
+	})
+	return err
+}
+
+// Refleja en el reporte del envío masivo el estado de un correo encolado
+func (ah *AuthHandler) updateBulkRow(accountID string, job QueuedEmail, status MessageStatus) {
+	if job.BulkID == "" {
+		return
+	}
+
+	row := BulkRowResult{Row: job.Row, Status: status.Status, ID: job.ID, MessageID: job.MessageID, Code: status.Code, Error: status.Error}
+	if len(job.Request.To) > 0 {
+		row.Email = job.Request.To[0]
+	}
+	if err := ah.saveBulkRows(accountID, job.BulkID, row); err != nil {
+		log.Println("Error actualizando el reporte del envío masivo", job.BulkID, ":", err)
+	}
+}
+
+func writeBulkReport(c *gin.Context, status int, report BulkReport) {
+	if c.Query("format") != "csv" {
+		c.JSON(status, report)
+		return
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"row", "email", "status", "id", "messageId", "code", "error"})
+	for _, r := range report.Rows {
+		w.Write([]string{strconv.Itoa(r.Row), r.Email, r.Status, r.ID, r.MessageID, r.Code, r.Error})
+	}
+	w.Flush()
+
+	c.Header("Content-Disposition", `attachment; filename="bulk-`+report.ID+`.csv"`)
+	c.Data(status, "text/csv; charset=utf-8", buf.Bytes())
+}
+
+// Cola de envíos en segundo plano. Cada elemento de la lista es un correo
+// cifrado con QUEUE_KEY; mientras se envía pasa a la lista de procesamiento.
+// Los reintentos esperan en un conjunto ordenado por la hora del próximo
+// intento y los correos que no se pudieron entregar van a una cola de
+// mensajes fallidos (dead letters) por cuenta.
+const (
+	emailQueue      = "queue:emails"
+	processingQueue = "queue:processing"
+	delayedQueue    = "queue:delayed"
+	drainLock       = "queue:lock"
+
+	// Duración máxima de cada vaciado, por debajo del límite de duración por
+	// defecto de las funciones de Vercel (10 s). Los envíos se cortan al
+	// vencer el plazo y no se empieza ninguno si queda menos de minSendTime.
+	drainBudget = 8 * time.Second
+	minSendTime = 2 * time.Second
+
+	// El estado de los correos encolados se puede consultar durante una semana
+	messageStatusTTL = 7 * 24 * time.Hour
+
+	// Espera antes del primer reintento; se duplica en cada intento
+	retryBaseDelay = time.Minute
+	retryMaxDelay  = 2 * time.Hour
+
+	defaultMaxAttempts = 5
+)
+
+// Estados de un correo encolado
+const (
+	statusQueued   = "queued"
+	statusRetrying = "retrying"
+	statusSent     = "sent"
+	statusFailed   = "failed" // está en la cola de fallidos y se puede reenviar
+)
+
+// Correo encolado. No incluye el token: guarda la clave de API con la que se
+// encoló, para comprobar que no se revocó antes de enviarlo, y la clave de la
+// cuenta para que el worker pueda desencriptar la credencial. Por eso se guarda
+// cifrado con QUEUE_KEY.
+type QueuedEmail struct {
+	ID         string       `json:"id"`
+	AccountID  string       `json:"accountId,omitempty"`
+	KeyID      string       `json:"keyId,omitempty"`
+	AccountKey string       `json:"accountKey,omitempty"`
+	Token      string       `json:"token,omitempty"` // correos encolados antes de guardar la clave de API
+	MessageID  string       `json:"messageId"`
+	Request    EmailRequest `json:"request"`
+	QueuedAt   time.Time    `json:"queuedAt"`
+	Attempts   int          `json:"attempts"`
+
+	// Fila del envío masivo al que pertenece, si es parte de uno
+	BulkID string `json:"bulkId,omitempty"`
+	Row    int    `json:"row,omitempty"`
+
+	// Si no está vacío, el reintento solo se envía a estos destinatarios
+	Recipients []string `json:"recipients,omitempty"`
+}
+
+// Asocia el correo a la cuenta y a la clave de API con la que se envía
+func (job *QueuedEmail) setAccount(account Account) {
+	job.AccountID, job.KeyID, job.Token = account.ID, account.apiKey.ID, ""
+	job.AccountKey = hex.EncodeToString(account.key)
+}
+
+// Estado de un correo encolado, consultable con GET /messages/:id
+type MessageStatus struct {
+	ID            string                   `json:"id"`
+	MessageID     string                   `json:"messageId"`
+	Status        string                   `json:"status"`
+	QueuedAt      time.Time                `json:"queuedAt"`
+	Attempts      int                      `json:"attempts"`
+	NextAttemptAt *time.Time               `json:"nextAttemptAt,omitempty"`
+	SentAt        *time.Time               `json:"sentAt,omitempty"`
+	Recipients    []mailer.RecipientResult `json:"recipients,omitempty"`
+	Code          string                   `json:"code,omitempty"`
+	Error         string                   `json:"error,omitempty"`
+}
+
+func (s *MessageStatus) fail(status string, err error) {
+	s.Status = status
+	s.Error = err.Error()
+
+	var apiErr *apiError
+	var mailErr *mailer.Error
+	if errors.As(err, &apiErr) {
+		s.Code = apiErr.Code
+	} else if errors.As(err, &mailErr) {
+		s.Code = mailErr.Code
+	}
+}
+
+// Correo de la cola de fallidos, con el destinatario y el asunto para poder
+// identificarlo antes de reenviarlo
+type DeadLetter struct {
+	MessageStatus
+	To      Recipients `json:"to"`
+	Subject string     `json:"subject"`
+}
+
+func messageStatusKey(accountID, id string) string {
+	return "message:" + accountID + ":" + id
+}
+
+// Los correos fallidos de cada cuenta se guardan cifrados en un hash indexado
+// por id. Caducan con su estado: el hash expira messageStatusTTL después del
+// último fallo y las entradas cuyo estado ya expiró se borran al leerlas.
+func deadLetterKey(accountID string) string {
+	return "deadletter:" + accountID
+}
+
+// Los errores temporales se reintentan: respuestas SMTP 4xx, fallos de red y
+// Redis sin responder al preparar la credencial
+func temporaryFailure(err error) bool {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.Code == "storage_error" {
+		return true
+	}
+	return mailer.Temporary(err)
+}
+
+// Espera exponencial con jitter: entre la mitad y el total de
+// retryBaseDelay * 2^(intento-1), sin pasar de retryMaxDelay
+func retryDelay(attempt int) time.Duration {
+	delay := retryMaxDelay
+	if attempt < 16 {
+		delay = min(retryBaseDelay<<(attempt-1), retryMaxDelay)
+	}
+	return delay/2 + time.Duration(mathrand.Int64N(int64(delay/2)+1))
+}
+
+func (ah *AuthHandler) encryptJob(job QueuedEmail) (string, error) {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := ah.cryptoService.encrypt(data, queueSecret)
+	if err != nil {
+		return "", &apiError{Code: "encryption_failed", Err: err}
+	}
+	return hex.EncodeToString(encrypted), nil
+}
+
+func (ah *AuthHandler) decryptJob(item string) (QueuedEmail, error) {
+	var job QueuedEmail
+	encrypted, err := hex.DecodeString(item)
+	if err != nil {
+		return job, err
+	}
+	data, err := ah.cryptoService.decrypt(encrypted, queueSecret)
+	if err != nil {
+		return job, err
+	}
+	return job, json.Unmarshal(data, &job)
+}
+
+// Guarda el estado y pone el correo en la cola. El estado se guarda antes de
+// encolar para que el worker siempre lo encuentre.
+func (ah *AuthHandler) pushJob(account Account, job QueuedEmail, status MessageStatus) error {
+	item, err := ah.encryptJob(job)
+	if err != nil {
+		return err
+	}
+	if err := ah.redisService.saveObjectFor(ah.client, messageStatusKey(account.ID, job.ID), status, messageStatusTTL); err != nil {
+		return &apiError{Code: "storage_error", Err: err}
+	}
+	if err := ah.client.LPush(ctx, emailQueue, item).Err(); err != nil {
+		return &apiError{Code: "storage_error", Err: err}
+	}
+	ah.updateBulkRow(account.ID, job, status)
+	return nil
+}
+
+func (ah *AuthHandler) enqueueEmail(account Account, credential Credential, request EmailRequest) (MessageStatus, error) {
+	job := QueuedEmail{
+		ID:        newID(),
+		MessageID: mailer.NewMessageID(credential.Email),
+		Request:   request,
+		QueuedAt:  time.Now().UTC(),
+	}
+	job.setAccount(account)
+	status := MessageStatus{ID: job.ID, MessageID: job.MessageID, Status: statusQueued, QueuedAt: job.QueuedAt}
+	return status, ah.pushJob(account, job, status)
+}
+
+// Programa el próximo intento de un correo que falló con un error temporal
+func (ah *AuthHandler) scheduleRetry(account Account, job QueuedEmail, status *MessageStatus, err error) error {
+	next := time.Now().UTC().Add(retryDelay(job.Attempts))
+	status.fail(statusRetrying, err)
+	status.NextAttemptAt = &next
+
+	item, err := ah.encryptJob(job)
+	if err != nil {
+		return err
+	}
+	if err := ah.redisService.saveObjectFor(ah.client, messageStatusKey(account.ID, job.ID), status, messageStatusTTL); err != nil {
+		return &apiError{Code: "storage_error", Err: err}
+	}
+	if err := ah.client.ZAdd(ctx, delayedQueue, &redis.Z{Score: float64(next.Unix()), Member: item}).Err(); err != nil {
+		return &apiError{Code: "storage_error", Err: err}
+	}
+	ah.updateBulkRow(account.ID, job, *status)
+	return nil
+}
+
+// Mueve el correo a la cola de fallidos. Su estado no expira mientras siga ahí.
+func (ah *AuthHandler) deadLetter(account Account, job QueuedEmail, status *MessageStatus, err error) error {
+	status.fail(statusFailed, err)
+
+	// Los fallidos no guardan la clave de la cuenta: se reenvían con la de
+	// quien los pide (ver replayDeadLetter)
+	job.AccountKey, job.Token = "", ""
+	item, err := ah.encryptJob(job)
+	if err != nil {
+		return err
+	}
+	if err := ah.redisService.saveObjectFor(ah.client, messageStatusKey(account.ID, job.ID), status, messageStatusTTL); err != nil {
+		return &apiError{Code: "storage_error", Err: err}
+	}
+	_, err = ah.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, deadLetterKey(account.ID), job.ID, item)
+		pipe.Expire(ctx, deadLetterKey(account.ID), messageStatusTTL)
+		return nil
+	})
+	if err != nil {
+		return &apiError{Code: "storage_error", Err: err}
+	}
+	ah.updateBulkRow(account.ID, job, *status)
+	return nil
+}
+
+// Si el servidor aceptó el mensaje y solo difirió a algunos destinatarios, el
+// reintento se envía únicamente a ellos
+func (job *QueuedEmail) narrow(result mailer.Result, err error) {
+	var mailErr *mailer.Error
+	if !errors.As(err, &mailErr) || mailErr.Code != mailer.CodeRecipientsDeferred {
+		return
+	}
+	job.Recipients = nil
+	for _, rcpt := range result.Deferred() {
+		job.Recipients = append(job.Recipients, rcpt.Address)
+	}
+}
+
+// Pasa a la cola de reintentos un envío directo que falló con un error
+// temporal, o solo a sus destinatarios diferidos; cuenta como el primer intento
+func (ah *AuthHandler) retryLater(account Account, msg *mailer.Message, request EmailRequest, result mailer.Result, err error) (MessageStatus, error) {
+	job := QueuedEmail{
+		ID:        newID(),
+		MessageID: msg.MessageID,
+		Request:   request,
+		QueuedAt:  msg.Date.UTC(),
+		Attempts:  1,
+	}
+	job.setAccount(account)
+	job.narrow(result, err)
+	if job.MessageID == "" {
+		job.MessageID = mailer.NewMessageID(msg.From)
+	}
+	if msg.Date.IsZero() {
+		job.QueuedAt = time.Now().UTC()
+	}
+
+	status := MessageStatus{ID: job.ID, MessageID: job.MessageID, QueuedAt: job.QueuedAt, Attempts: job.Attempts, Recipients: result.Recipients}
+	return status, ah.scheduleRetry(account, job, &status, err)
+}
+
+// Vacía la cola enviando los correos pendientes. Lo llama el cron de Vercel
+// (ver vercel.json) con el header Authorization: Bearer CRON_SECRET.
+func (ah *AuthHandler) drainQueueHandler(c *gin.Context) {
+	if cronSecret == "" || c.GetHeader("Authorization") != "Bearer "+cronSecret {
+		respondError(c, http.StatusForbidden, "forbidden")
+		return
+	}
+	if queueSecret == nil {
+		respondError(c, http.StatusServiceUnavailable, "async_unavailable")
+		return
+	}
+
+	// Un solo worker a la vez; si hay otro vaciando la cola no se hace nada.
+	// El lock dura más que el vaciado, de modo que otro worker no puede
+	// devolver a la cola un correo que se está enviando.
+	owner := newID()
+	locked, err := ah.client.SetNX(ctx, drainLock, owner, drainBudget+15*time.Second).Result()
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, &apiError{Code: "storage_error", Err: err})
+		return
+	}
+	if !locked {
+		c.JSON(http.StatusOK, gin.H{"processed": 0})
+		return
+	}
+	defer ah.releaseDrainLock(owner)
+
+	// Lo que quedó en procesamiento es de un worker que terminó a la mitad
+	for {
+		if err := ah.client.RPopLPush(ctx, processingQueue, emailQueue).Err(); err != nil {
+			break
+		}
+	}
+
+	// Los reintentos que ya vencieron vuelven a la cola
+	due, err := ah.client.ZRangeByScore(ctx, delayedQueue, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().Unix(), 10),
+	}).Result()
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, &apiError{Code: "storage_error", Err: err})
+		return
+	}
+	for _, item := range due {
+		if err := ah.client.LPush(ctx, emailQueue, item).Err(); err != nil {
+			sendError(c, http.StatusInternalServerError, &apiError{Code: "storage_error", Err: err})
+			return
+		}
+		ah.client.ZRem(ctx, delayedQueue, item)
+	}
+
+	processed := 0
+	deadline := time.Now().Add(drainBudget)
+	sendCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	for time.Until(deadline) >= minSendTime {
+		item, err := ah.client.RPopLPush(ctx, emailQueue, processingQueue).Result()
+		if err == redis.Nil {
+			break
+		}
+		if err != nil {
+			sendError(c, http.StatusInternalServerError, &apiError{Code: "storage_error", Err: err})
+			return
+		}
+
+		if ah.processQueuedEmail(sendCtx, item) {
+			ah.client.LRem(ctx, processingQueue, 1, item)
+		}
+		processed++
+	}
+
+	c.JSON(http.StatusOK, gin.H{"processed": processed})
+}
+
+// Libera el lock del vaciado solo si sigue siendo de este worker: si expiró,
+// ya puede tenerlo otro
+func (ah *AuthHandler) releaseDrainLock(owner string) {
+	err := ah.client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := tx.Get(ctx, drainLock).Result()
+		if err != nil || current != owner {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, drainLock)
+			return nil
+		})
+		return err
+	}, drainLock)
+	// Si el lock ya no existe o cambió de dueño no hay nada que liberar
+	if err != nil && !errors.Is(err, redis.Nil) && !errors.Is(err, redis.TxFailedErr) {
+		log.Println("Error liberando el lock de la cola:", err)
+	}
+}
+
+// Envía un correo de la cola y guarda el resultado en su estado. Si falla con
+// un error temporal se reintenta más tarde; si el error es definitivo o se
+// agotan los intentos pasa a la cola de fallidos. sendCtx limita solo el envío:
+// el estado se guarda aunque haya vencido. Devuelve false si el correo debe
+// quedar en procesamiento para el próximo vaciado.
+func (ah *AuthHandler) processQueuedEmail(sendCtx context.Context, item string) bool {
+	job, err := ah.decryptJob(item)
+	if err != nil {
+		log.Println("Correo encolado ilegible, se descarta:", err)
+		return true
+	}
+
+	account, err := ah.jobAccount(job)
+	if err != nil {
+		// La clave de API se revocó o la cuenta ya no existe
+		var apiErr *apiError
+		if errors.As(err, &apiErr) && apiErr.Code == "unknown_token" {
+			// Con el id de la cuenta pasa a fallidos y se puede reenviar con otra clave
+			if job.AccountID == "" {
+				log.Println("El token del correo encolado ya no es válido, se descarta:", job.ID)
+				return true
+			}
+			job.Token = ""
+			status := MessageStatus{ID: job.ID, MessageID: job.MessageID, QueuedAt: job.QueuedAt, Attempts: job.Attempts}
+			if err := ah.deadLetter(Account{ID: job.AccountID}, job, &status, err); err != nil {
+				log.Println("Error guardando el estado del correo", job.ID, ":", err)
+			}
+			return true
+		}
+		log.Println("Error buscando la cuenta del correo encolado", job.ID, ":", err)
+		return false
+	}
+	// Los reintentos ya no guardan el token de los correos antiguos
+	job.setAccount(account)
+
+	job.Attempts++
+	status := MessageStatus{ID: job.ID, MessageID: job.MessageID, Status: statusSent, QueuedAt: job.QueuedAt, Attempts: job.Attempts}
+
+	result, err := ah.sendQueuedEmail(sendCtx, account, job)
+	if err == nil {
+		// El servidor aceptó el mensaje pero difirió a algunos destinatarios
+		err = result.DeferredError()
+	}
+	status.Recipients = ah.mergeRecipients(account, job, result.Recipients)
+	job.narrow(result, err)
+	switch {
+	case err == nil:
+		now := time.Now().UTC()
+		status.SentAt = &now
+		err = ah.redisService.saveObjectFor(ah.client, messageStatusKey(account.ID, job.ID), status, messageStatusTTL)
+		if err == nil {
+			ah.updateBulkRow(account.ID, job, status)
+		}
+	case temporaryFailure(err) && job.Attempts < maxAttempts:
+		err = ah.scheduleRetry(account, job, &status, err)
+	default:
+		err = ah.deadLetter(account, job, &status, err)
+	}
+	if err != nil {
+		log.Println("Error guardando el estado del correo", job.ID, ":", err)
+	}
+	return true
+}
+
+// Cuenta de un correo encolado. Falla con unknown_token si la clave de API con
+// la que se encoló ya no existe.
+func (ah *AuthHandler) jobAccount(job QueuedEmail) (Account, error) {
+	if job.Token != "" {
+		tokenBytes, err := hex.DecodeString(job.Token)
+		if err != nil {
+			return Account{}, &apiError{Code: "unknown_token", Err: err}
+		}
+		return ah.resolveAccount(job.Token, tokenBytes)
+	}
+
+	account := Account{ID: job.AccountID}
+	if err := ah.redisService.getField(ah.client, apiKeysKey(job.AccountID), job.KeyID, &account.apiKey); err != nil {
+		if errors.Is(err, errNotFound) {
+			return Account{}, &apiError{Code: "unknown_token"}
+		}
+		return Account{}, &apiError{Code: "storage_error", Err: err}
+	}
+	key, err := hex.DecodeString(job.AccountKey)
+	if err != nil {
+		return Account{}, &apiError{Code: "decryption_failed", Err: err}
+	}
+	account.key = key
+	return account, nil
+}
+
+func (ah *AuthHandler) sendQueuedEmail(sendCtx context.Context, account Account, job QueuedEmail) (mailer.Result, error) {
+	credential, err := ah.prepareCredential(sendCtx, account, job.Request.TLSPolicy)
+	if err != nil {
+		return mailer.Result{}, err
+	}
+
+	msg := job.Request.message()
+	msg.MessageID = job.MessageID
+	msg.Date = job.QueuedAt
+	msg.RcptTo = job.Recipients
+	return ah.emailService.send(sendCtx, credential, msg)
+}
+
+// Un reintento parcial solo trae el resultado de los destinatarios diferidos;
+// el de los demás se conserva del estado anterior
+func (ah *AuthHandler) mergeRecipients(account Account, job QueuedEmail, recipients []mailer.RecipientResult) []mailer.RecipientResult {
+	if len(job.Recipients) == 0 {
+		return recipients
+	}
+	var previous MessageStatus
+	if err := ah.redisService.getObject(ah.client, messageStatusKey(account.ID, job.ID), &previous); err != nil {
+		return recipients
+	}
+
+	var merged []mailer.RecipientResult
+	for _, rcpt := range previous.Recipients {
+		if !slices.Contains(job.Recipients, rcpt.Address) {
+			merged = append(merged, rcpt)
+		}
+	}
+	return append(merged, recipients...)
+}
+
+// Estado de un correo enviado con async
+func (ah *AuthHandler) messageStatusHandler(c *gin.Context) {
+	account := currentAccount(c)
+
+	var status MessageStatus
+	if err := ah.redisService.getObject(ah.client, messageStatusKey(account.ID, c.Param("id")), &status); err != nil {
+		if errors.Is(err, redis.Nil) {
+			respondError(c, http.StatusNotFound, "message_not_found")
+			return
+		}
+		sendError(c, http.StatusInternalServerError, &apiError{Code: "storage_error", Err: err})
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// Correos de la cuenta que no se pudieron entregar
+func (ah *AuthHandler) listDeadLetters(c *gin.Context) {
+	account := currentAccount(c)
+	if queueSecret == nil {
+		respondError(c, http.StatusServiceUnavailable, "async_unavailable")
+		return
+	}
+
+	items, err := ah.redisService.getFields(ah.client, deadLetterKey(account.ID))
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, &apiError{Code: "storage_error", Err: err})
+		return
+	}
+
+	letters := []DeadLetter{}
+	for id, item := range items {
+		job, err := ah.decryptJob(item)
+		if err != nil {
+			log.Println("Correo fallido ilegible", id, ":", err)
+			continue
+		}
+
+		letter := DeadLetter{To: job.Request.To, Subject: job.Request.Subject}
+		err = ah.redisService.getObject(ah.client, messageStatusKey(account.ID, id), &letter.MessageStatus)
+		if errors.Is(err, redis.Nil) {
+			// Su estado expiró: el correo fallido también
+			ah.deleteDeadLetter(account, id)
+			continue
+		}
+		if err != nil {
+			letter.MessageStatus = MessageStatus{ID: id, MessageID: job.MessageID, Status: statusFailed, QueuedAt: job.QueuedAt, Attempts: job.Attempts}
+		}
+		letters = append(letters, letter)
+	}
+
+	sort.Slice(letters, func(i, j int) bool { return letters[i].QueuedAt.Before(letters[j].QueuedAt) })
+	c.JSON(http.StatusOK, letters)
+}
+
+// Borra un correo fallido cuyo estado ya expiró
+func (ah *AuthHandler) deleteDeadLetter(account Account, id string) {
+	if err := ah.redisService.deleteField(ah.client, deadLetterKey(account.ID), id); err != nil && !errors.Is(err, errNotFound) {
+		log.Println("Error borrando el correo fallido expirado", id, ":", err)
+	}
+}
+
+// Saca un correo de la cola de fallidos y lo vuelve a encolar con los
+// intentos en cero
+func (ah *AuthHandler) replayDeadLetter(c *gin.Context) {
+	account := currentAccount(c)
+	if queueSecret == nil {
+		respondError(c, http.StatusServiceUnavailable, "async_unavailable")
+		return
+	}
+
+	id := c.Param("id")
+	item, err := ah.client.HGet(ctx, deadLetterKey(account.ID), id).Result()
+	if err == redis.Nil {
+		respondError(c, http.StatusNotFound, "message_not_found")
+		return
+	}
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, &apiError{Code: "storage_error", Err: err})
+		return
+	}
+
+	if n, err := ah.client.Exists(ctx, messageStatusKey(account.ID, id)).Result(); err == nil && n == 0 {
+		ah.deleteDeadLetter(account, id)
+		respondError(c, http.StatusNotFound, "message_not_found")
+		return
+	}
+
+	job, err := ah.decryptJob(item)
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, &apiError{Code: "decryption_failed", Err: err})
+		return
+	}
+	// Se reenvía con la clave de quien lo pide: el correo fallido no guarda la
+	// de la cuenta y la clave de API original pudo revocarse
+	job.setAccount(account)
+	job.Attempts = 0
+
+	status := MessageStatus{ID: job.ID, MessageID: job.MessageID, Status: statusQueued, QueuedAt: job.QueuedAt}
+	if err := ah.pushJob(account, job, status); err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := ah.redisService.deleteField(ah.client, deadLetterKey(account.ID), id); err != nil {
+		sendError(c, http.StatusInternalServerError, &apiError{Code: "storage_error", Err: err})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":   i18n.T(lang(c), "email_queued"),
+		"id":        status.ID,
+		"messageId": status.MessageID,
+		"status":    status.Status,
+	})
+}
+
+// Plantillas de la cuenta del token
+
+func (ah *AuthHandler) listTemplates(c *gin.Context) {
+	account := currentAccount(c)
+
+	fields, err := ah.redisService.getFields(ah.client, templatesKey(account.ID))
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, &apiError{Code: "storage_error", Err: err})
+		return
+	}
+
+	templates := []mailer.Template{}
+	for _, data := range fields {
+		var tmpl mailer.Template
+		if err := json.Unmarshal([]byte(data), &tmpl); err != nil {
+			respondError(c, http.StatusInternalServerError, "internal_error")
+			return
+		}
+		templates = append(templates, tmpl)
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].CreatedAt.Before(templates[j].CreatedAt)
+	})
+
+	c.JSON(http.StatusOK, gin.H{"templates": templates})
+}
+
+func (ah *AuthHandler) createTemplate(c *gin.Context) {
+	account := currentAccount(c)
+
+	var tmpl mailer.Template
+	if err := c.ShouldBindJSON(&tmpl); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	if err := tmpl.Validate(); err != nil {
+		sendError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	tmpl.ID = newID()
+	tmpl.CreatedAt = time.Now().UTC()
+	tmpl.UpdatedAt = tmpl.CreatedAt
+
+	if err := ah.redisService.saveField(ah.client, templatesKey(account.ID), tmpl.ID, tmpl); err != nil {
+		sendError(c, http.StatusInternalServerError, &apiError{Code: "storage_error", Err: err})
+		return
+	}
+
+	c.JSON(http.StatusCreated, tmpl)
+}
+
+func (ah *AuthHandler) getTemplateHandler(c *gin.Context) {
+	account := currentAccount(c)
+
+	tmpl, err := ah.getTemplate(account.ID, c.Param("id"))
+	if err != nil {
+		sendTemplateError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, tmpl)
+}
+
+func (ah *AuthHandler) updateTemplate(c *gin.Context) {
+	account := currentAccount(c)
+
+	current, err := ah.getTemplate(account.ID, c.Param("id"))
+	if err != nil {
+		sendTemplateError(c, err)
+		return
+	}
 
-// Struct definitions
-type EmailRequest struct {
-	To       string `json:"to"`
-	Subject  string `json:"subject"`
-	HtmlBody string `json:"htmlBody"`
+	var tmpl mailer.Template
+	if err := c.ShouldBindJSON(&tmpl); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	if err := tmpl.Validate(); err != nil {
+		sendError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	tmpl.ID = current.ID
+	tmpl.CreatedAt = current.CreatedAt
+	tmpl.UpdatedAt = time.Now().UTC()
+
+	if err := ah.redisService.saveField(ah.client, templatesKey(account.ID), tmpl.ID, tmpl); err != nil {
+		sendError(c, http.StatusInternalServerError, &apiError{Code: "storage_error", Err: err})
+		return
+	}
+
+	c.JSON(http.StatusOK, tmpl)
 }
 
-type Credential struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+func (ah *AuthHandler) deleteTemplate(c *gin.Context) {
+	account := currentAccount(c)
+
+	if err := ah.redisService.deleteField(ah.client, templatesKey(account.ID), c.Param("id")); err != nil {
+		if errors.Is(err, errNotFound) {
+			sendTemplateError(c, &mailer.Error{Code: mailer.CodeTemplateNotFound, Message: "la plantilla no existe"})
+			return
+		}
+		sendError(c, http.StatusInternalServerError, &apiError{Code: "storage_error", Err: err})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": i18n.T(lang(c), "template_deleted")})
 }
 
-type EncryptedInfo struct {
-	Key   string `json:"key"`   
-	Value string `json:"value"`
+func (ah *AuthHandler) getTemplate(accountID, id string) (mailer.Template, error) {
+	var tmpl mailer.Template
+	if err := ah.redisService.getField(ah.client, templatesKey(accountID), id, &tmpl); err != nil {
+		if errors.Is(err, errNotFound) {
+			return tmpl, &mailer.Error{Code: mailer.CodeTemplateNotFound, Message: "la plantilla " + id + " no existe"}
+		}
+		return tmpl, err
+	}
+	return tmpl, nil
 }
 
-// Global variables
-var (
-	ctx = context.Background()
-	redisClient *redis.Client
-)
+// Las plantillas de cada cuenta se guardan en un hash indexado por id
+func templatesKey(accountID string) string {
+	return "templates:" + accountID
+}
 
-// Inicialización global de Redis
-func initRedis() *redis.Client {
-	redisURL := os.Getenv("REDIS_URL")
-	if redisURL == "" {
-		log.Fatal("REDIS_URL no está establecido en las variables de entorno")
+// Identificador aleatorio para los objetos que crea la API
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Clave del contexto de gin con la cuenta autenticada
+const accountCtxKey = "account"
+
+// Middleware que autentica la solicitud con una clave de API y exige que
+// tenga el permiso de la ruta
+func (ah *AuthHandler) requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		account, ok := ah.authenticate(c)
+		if !ok {
+			c.Abort()
+			return
+		}
+		if !account.apiKey.allows(scope) {
+			respondError(c, http.StatusForbidden, "insufficient_scope", scope)
+			c.Abort()
+			return
+		}
+
+		ah.touchAPIKey(&account)
+		c.Set(accountCtxKey, account)
+		c.Next()
 	}
+}
 
-	opt, err := redis.ParseURL(redisURL)
+// Cuenta autenticada por requireScope
+func currentAccount(c *gin.Context) Account {
+	return c.MustGet(accountCtxKey).(Account)
+}
+
+// Actualiza el último uso de la clave de API, como mucho una vez por minuto
+// para no escribir en Redis en cada solicitud. Se actualiza con WATCH sobre lo
+// guardado para no volver a crear una clave revocada mientras tanto.
+func (ah *AuthHandler) touchAPIKey(account *Account) {
+	now := time.Now().UTC()
+	if last := account.apiKey.LastUsedAt; last != nil && now.Sub(*last) < time.Minute {
+		return
+	}
+
+	account.apiKey.LastUsedAt = &now
+	key := apiKeysKey(account.ID)
+	err := ah.client.Watch(ctx, func(tx *redis.Tx) error {
+		data, err := tx.HGet(ctx, key, account.apiKey.ID).Bytes()
+		if err != nil {
+			return err
+		}
+
+		var stored APIKey
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return err
+		}
+		stored.LastUsedAt = &now
+		if data, err = json.Marshal(stored); err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, account.apiKey.ID, data)
+			return nil
+		})
+		return err
+	}, key)
+
+	// Si la clave se revocó o cambió mientras tanto no hay nada que guardar
+	if err != nil && !errors.Is(err, redis.Nil) && !errors.Is(err, redis.TxFailedErr) {
+		log.Println("Error guardando el último uso de la clave de API:", err)
+	}
+}
+
+// Comprueba el token Bearer y devuelve la cuenta a la que pertenece
+func (ah *AuthHandler) authenticate(c *gin.Context) (Account, bool) {
+	token, tokenBytes, ok := bearerToken(c)
+	if !ok {
+		return Account{}, false
+	}
+
+	account, err := ah.resolveAccount(token, tokenBytes)
 	if err != nil {
-		log.Fatalf("Error al parsear la URL de Redis: %v", err)
+		var apiErr *apiError
+		if errors.As(err, &apiErr) && apiErr.Code == "unknown_token" {
+			respondError(c, http.StatusUnauthorized, "unknown_token")
+			return Account{}, false
+		}
+		sendError(c, http.StatusInternalServerError, err)
+		return Account{}, false
+	}
+	return account, true
+}
+
+// Busca la cuenta y la clave de API del token por su hash y desenvuelve la
+// clave de la cuenta. Los tokens antiguos se migran al esquema nuevo la
+// primera vez que se usan.
+func (ah *AuthHandler) resolveAccount(token string, tokenBytes []byte) (Account, error) {
+	derived, err := ah.cryptoService.deriveKey(tokenBytes)
+	if err != nil {
+		return Account{}, err
 	}
 
-	return redis.NewClient(opt)
+	hash := tokenHash(tokenBytes)
+	value, err := ah.client.Get(ctx, tokenIndexKey(hash)).Result()
+	if err == redis.Nil {
+		legacy, err := ah.redisService.exists(ah.client, token)
+		if err != nil {
+			return Account{}, &apiError{Code: "storage_error", Err: err}
+		}
+		if !legacy {
+			return Account{}, &apiError{Code: "unknown_token"}
+		}
+		if err := ah.migrateLegacyAccount(Account{ID: newID(), token: token, key: derived}, tokenBytes); err != nil {
+			return Account{}, err
+		}
+		return ah.resolveAccount(token, tokenBytes)
+	}
+	if err != nil {
+		return Account{}, &apiError{Code: "storage_error", Err: err}
+	}
+
+	accountID, keyID, scoped := strings.Cut(value, ":")
+	account := Account{ID: accountID, token: token, key: derived}
+
+	// Cuenta anterior a las claves de API: su clave es la derivada del token,
+	// que pasa a ser su clave principal con todos los permisos. El id sale del
+	// hash para que dos solicitudes simultáneas creen la misma.
+	if !scoped {
+		account.apiKey = newAPIKey("default", allScopes, token)
+		account.apiKey.ID = hash[:16]
+		if err := ah.saveAPIKey(account, &account.apiKey, tokenBytes); err != nil {
+			return Account{}, err
+		}
+		return account, nil
+	}
+
+	if err := ah.redisService.getField(ah.client, apiKeysKey(accountID), keyID, &account.apiKey); err != nil {
+		if errors.Is(err, errNotFound) {
+			return Account{}, &apiError{Code: "unknown_token"}
+		}
+		return Account{}, &apiError{Code: "storage_error", Err: err}
+	}
+
+	if account.apiKey.WrappedKey != "" {
+		wrapped, err := hex.DecodeString(account.apiKey.WrappedKey)
+		if err == nil {
+			account.key, err = ah.cryptoService.decrypt(wrapped, derived)
+		}
+		if err != nil {
+			return Account{}, &apiError{Code: "decryption_failed"}
+		}
+	}
+	return account, nil
 }
 
-// Inicialización una vez al cargar el módulo
-func init() {
-	redisClient = initRedis()
+// Guarda la clave de API y la indexa por el hash de su token. La clave de la
+// cuenta se guarda envuelta con la derivada del token, salvo que sean la misma
+// (cuentas anteriores a las claves de API).
+func (ah *AuthHandler) saveAPIKey(account Account, apiKey *APIKey, tokenBytes []byte) error {
+	derived, err := ah.cryptoService.deriveKey(tokenBytes)
+	if err != nil {
+		return err
+	}
+
+	apiKey.WrappedKey = ""
+	if !bytes.Equal(derived, account.key) {
+		wrapped, err := ah.cryptoService.encrypt(account.key, derived)
+		if err != nil {
+			return &apiError{Code: "encryption_failed", Err: err}
+		}
+		apiKey.WrappedKey = hex.EncodeToString(wrapped)
+	}
+	apiKey.TokenHash = tokenHash(tokenBytes)
+
+	if err := ah.redisService.saveField(ah.client, apiKeysKey(account.ID), apiKey.ID, apiKey); err != nil {
+		return &apiError{Code: "storage_error", Err: err}
+	}
+	if err := ah.client.Set(ctx, tokenIndexKey(apiKey.TokenHash), account.ID+":"+apiKey.ID, 0).Err(); err != nil {
+		return &apiError{Code: "storage_error", Err: err}
+	}
+	return nil
 }
 
-// Email Service
-type EmailService struct{}
-
-func (es *EmailService) send(from, password, to, subject, htmlBody string) error {
-	message := []byte("MIME-Version: 1.0\r\n" +
-		"Content-Type: text/html; charset=UTF-8\r\n" +
-		"Subject: " + subject + "\r\n" +
-		"To: " + to + "\r\n" +
-		"From: " + from + "\r\n" +
-		"\r\n" +
-		htmlBody)
-
-	auth := smtp.PlainAuth("", from, password, smtpServer)
-	return smtp.SendMail(smtpServer+":"+smtpPort, auth, from, []string{to}, message)
-}
-
-func (es *EmailService) sendWelcomeEmail(email, password, token string) error {
-	subject := "¡Bienvenido a MailApi! 🎉"
-	htmlBody := fmt.Sprintf(
-		"<html><body><h1>¡Hola ! 👋</h1>"+
-			"<p>Este es un correo de prueba desde <strong>MailApi</strong> 📧</p>"+
-			"<p>Si recibes este mensaje, ¡felicitaciones! El correo es válido ✅.</p>"+
-			"<p>Por favor, guarda bien el token que se te ha generado, ya que lo necesitarás para realizar solicitudes autenticadas.<br> El token es: <strong>%s</strong> 🗝️</p>"+
-			"<p>Para más información sobre cómo utilizar <strong>MailApi</strong>, haz clic en el siguiente enlace:</p>"+
-			"<p><a href='https://www.mailapi.com/guia-de-uso' target='_blank'>Guía de Uso de MailApi 📚</a></p>"+
-			"</body></html>", token)
-
-	if err := es.send(email, password, email, subject, htmlBody); err != nil {
-		log.Println("Error enviando el correo de prueba para verificacion:", err)
-		return fmt.Errorf("Credenciales incorrectas ")
+// Antes el token era el hash SHA3 de la contraseña y la cuenta se guardaba
+// bajo el propio token, cifrada con él. Se mueve a un id nuevo con los campos
+// cifrados con la clave derivada y sus datos se renombran; el token sigue
+// siendo válido.
+func (ah *AuthHandler) migrateLegacyAccount(account Account, tokenBytes []byte) error {
+	var info EncryptedInfo
+	if err := ah.redisService.getObject(ah.client, account.token, &info); err != nil {
+		return &apiError{Code: "storage_error", Err: err}
+	}
+
+	if err := ah.newRecordKey(account, &info); err != nil {
+		return err
+	}
+	if err := ah.reencrypt(&info, tokenBytes, info.key); err != nil {
+		return err
 	}
 
+	if err := ah.redisService.saveObject(ah.client, accountKey(account.ID), info); err != nil {
+		return &apiError{Code: "storage_error", Err: err}
+	}
+
+	// Si otra solicitud migró la cuenta al mismo tiempo, vale la suya
+	created, err := ah.client.SetNX(ctx, tokenIndexKey(tokenHash(tokenBytes)), account.ID, 0).Result()
+	if err != nil {
+		return &apiError{Code: "storage_error", Err: err}
+	}
+	if !created {
+		ah.client.Del(ctx, accountKey(account.ID))
+		return nil
+	}
+
+	// Plantillas, correos fallidos, estados e informes pasan del token al id.
+	// Se buscan con SCAN para no bloquear Redis y se renombran al terminar,
+	// porque SCAN puede devolver una clave más de una vez.
+	keys := []string{templatesKey(account.token), deadLetterKey(account.token)}
+	for _, pattern := range []string{messageStatusKey(account.token, "*"), bulkReportKey(account.token, "*")} {
+		iter := ah.client.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+		}
+		if err := iter.Err(); err != nil {
+			log.Println("Error buscando los datos de la cuenta migrada:", err)
+		}
+	}
+	slices.Sort(keys)
+	for _, key := range slices.Compact(keys) {
+		newKey := strings.Replace(key, ":"+account.token, ":"+account.ID, 1)
+		if err := ah.redisService.rename(ah.client, key, newKey); err != nil {
+			log.Println("Error migrando", key, ":", err)
+		}
+	}
+
+	if err := ah.client.Del(ctx, account.token).Err(); err != nil {
+		log.Println("Error borrando la credencial antigua:", err)
+	}
 	return nil
 }
 
-// Crypto Service
-type CryptoService struct{}
+// Lee el token Bearer de la solicitud; si falta o no es válido responde el
+// error y devuelve ok en false
+func bearerToken(c *gin.Context) (token string, tokenBytes []byte, ok bool) {
+	authHeader := c.GetHeader("Authorization")
+	if authHeader == "" {
+		respondError(c, http.StatusUnauthorized, "missing_authorization")
+		return "", nil, false
+	}
 
-func (cs *CryptoService) deriveIVFromKey(key []byte) []byte {
-	hash := sha3.New256()
-	hash.Write(key)
-	return hash.Sum(nil)[:aes.BlockSize]
+	parts := strings.Fields(authHeader)
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		respondError(c, http.StatusUnauthorized, "invalid_authorization")
+		return "", nil, false
+	}
+
+	token = parts[1]
+	tokenBytes, err := hex.DecodeString(token)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_token")
+		return "", nil, false
+	}
+	return token, tokenBytes, true
 }
 
-func (cs *CryptoService) encrypt(plaintext []byte, key []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
+// Obtiene de Redis la credencial de la cuenta y la desencripta. También
+// devuelve el registro cifrado para poder actualizarlo.
+func (ah *AuthHandler) loadCredential(account Account) (Credential, EncryptedInfo, error) {
+	var dataCredential EncryptedInfo
+	if err := ah.redisService.getObject(ah.client, accountKey(account.ID), &dataCredential); err != nil {
+		return Credential{}, dataCredential, &apiError{Code: "storage_error", Err: err}
+	}
+
+	// Se activa si algún campo estaba cifrado con el formato antiguo
+	migrated := false
+	stored := dataCredential
+
+	if dataCredential.KeyID == "" && masterKeys != nil {
+		// Registro anterior a la clave maestra: se le asigna una clave de datos
+		tokenKey := account.key
+		if err := ah.newRecordKey(account, &dataCredential); err != nil {
+			return Credential{}, dataCredential, err
+		}
+		if err := ah.reencrypt(&dataCredential, tokenKey, dataCredential.key); err != nil {
+			return Credential{}, dataCredential, err
+		}
+		migrated = true
+	} else if err := ah.openRecordKey(account, &dataCredential); err != nil {
+		return Credential{}, dataCredential, err
+	}
+
+	decryptedPassword, err := ah.decryptField(&dataCredential.Key, dataCredential.key, &migrated)
 	if err != nil {
-		return nil, err
+		return Credential{}, dataCredential, &apiError{Code: "decryption_failed"}
 	}
 
-	iv := cs.deriveIVFromKey(key)
-	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
-	padText := append(plaintext, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	decryptedEmail, err := ah.decryptField(&dataCredential.Value, dataCredential.key, &migrated)
+	if err != nil {
+		return Credential{}, dataCredential, &apiError{Code: "decryption_failed"}
+	}
+
+	credential := Credential{
+		Email:    string(decryptedEmail),
+		Password: string(decryptedPassword),
+	}
+
+	// Servidor SMTP (los registros antiguos no lo tienen y usan Gmail)
+	if dataCredential.Server != "" {
+		decryptedServer, err := ah.decryptField(&dataCredential.Server, dataCredential.key, &migrated)
+		if err != nil {
+			return Credential{}, dataCredential, &apiError{Code: "decryption_failed"}
+		}
+
+		var server mailer.Server
+		if err := json.Unmarshal(decryptedServer, &server); err != nil {
+			return Credential{}, dataCredential, &apiError{Code: "invalid_credential"}
+		}
+		credential.Host = server.Host
+		credential.Port = server.Port
+		credential.Security = server.Security
+		credential.TLSPolicy = server.TLSPolicy
+		credential.AuthMechanism = server.AuthMechanism
+	}
+
+	// Datos OAuth
+	if dataCredential.OAuth != "" {
+		decryptedGrant, err := ah.decryptField(&dataCredential.OAuth, dataCredential.key, &migrated)
+		if err != nil {
+			return Credential{}, dataCredential, &apiError{Code: "decryption_failed"}
+		}
+
+		var grant OAuthGrant
+		if err := json.Unmarshal(decryptedGrant, &grant); err != nil {
+			return Credential{}, dataCredential, &apiError{Code: "invalid_credential"}
+		}
+		credential.OAuthProvider = grant.Provider
+		credential.RefreshToken = grant.RefreshToken
+	}
+
+	// Clave DKIM
+	if dataCredential.DKIM != "" {
+		decryptedKey, err := ah.decryptField(&dataCredential.DKIM, dataCredential.key, &migrated)
+		if err != nil {
+			return Credential{}, dataCredential, &apiError{Code: "decryption_failed"}
+		}
+
+		var key DKIMKey
+		if err := json.Unmarshal(decryptedKey, &key); err != nil {
+			return Credential{}, dataCredential, &apiError{Code: "invalid_credential"}
+		}
+		if credential.dkim, err = key.signer(); err != nil {
+			return Credential{}, dataCredential, &apiError{Code: "invalid_credential"}
+		}
+	}
 
-	ciphertext := make([]byte, len(padText))
-	cbc := cipher.NewCBCEncrypter(block, iv)
-	cbc.CryptBlocks(ciphertext, padText)
+	// La migración solo se guarda si nadie cambió el registro desde que se
+	// leyó; si no, se hará en otro uso
+	if migrated {
+		err := ah.updateRecord(account, func(info *EncryptedInfo) error {
+			if info.sameAs(stored) {
+				*info = dataCredential
+			}
+			return nil
+		})
+		if err != nil {
+			log.Println("Error guardando la credencial migrada:", err)
+		}
+	}
 
-	return append(iv, ciphertext...), nil
+	return credential, dataCredential, nil
 }
 
-func (cs *CryptoService) decrypt(ciphertext []byte, key []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
+// Carga la credencial para un envío: aplica la política TLS pedida (solo si es
+// más estricta), renueva el access token y guarda el refresh token si el
+// proveedor lo rotó.
+func (ah *AuthHandler) prepareCredential(sendCtx context.Context, account Account, policy mailer.TLSPolicy) (Credential, error) {
+	credential, _, err := ah.loadCredential(account)
 	if err != nil {
-		return nil, err
+		return Credential{}, err
 	}
 
-	iv := cs.deriveIVFromKey(key)
-	ciphertext = ciphertext[aes.BlockSize:]
+	credential.TLSPolicy = credential.server().TLSPolicy.Stricter(policy)
 
-	cbc := cipher.NewCBCDecrypter(block, iv)
-	plaintext := make([]byte, len(ciphertext))
-	cbc.CryptBlocks(plaintext, ciphertext)
+	storedRefreshToken := credential.RefreshToken
+	if err := ah.emailService.refreshAccessToken(sendCtx, &credential); err != nil {
+		return Credential{}, err
+	}
 
-	padding := plaintext[len(plaintext)-1]
-	return plaintext[:len(plaintext)-int(padding)], nil
-}
+	if credential.RefreshToken != storedRefreshToken {
+		grant := OAuthGrant{Provider: credential.OAuthProvider, RefreshToken: credential.RefreshToken}
+		err := ah.updateRecord(account, func(info *EncryptedInfo) error {
+			encryptedGrant, err := ah.encryptGrant(grant, info.key)
+			if err != nil {
+				return &apiError{Code: "encryption_failed", Err: err}
+			}
+			info.OAuth = encryptedGrant
+			return nil
+		})
+		if err != nil {
+			log.Println("Error guardando el refresh token rotado:", err)
+		}
+	}
 
-// Redis Service
-type RedisService struct{}
+	return credential, nil
+}
 
-func (rs *RedisService) saveObject(client *redis.Client, key string, obj interface{}) error {
-	data, err := json.Marshal(obj)
+// Desencripta un campo (en hexadecimal) del registro guardado. Si estaba en
+// el formato antiguo (CBC) lo re-encripta en el lugar y marca el registro
+// como migrado para que se guarde.
+func (ah *AuthHandler) decryptField(field *string, key []byte, migrated *bool) ([]byte, error) {
+	data, err := hex.DecodeString(*field)
 	if err != nil {
-		return fmt.Errorf("error al serializar el objeto: %v", err)
+		return nil, err
 	}
 
-	return client.Set(ctx, key, data, 0).Err()
+	plaintext, err := ah.cryptoService.decrypt(data, key)
+	if err != nil || !ah.cryptoService.legacy(data, key) {
+		return plaintext, err
+	}
+
+	encrypted, err := ah.cryptoService.encrypt(plaintext, key)
+	if err != nil {
+		// El campo sigue siendo legible; se migrará en otro momento
+		log.Println("Error migrando un campo cifrado:", err)
+		return plaintext, nil
+	}
+	*field = hex.EncodeToString(encrypted)
+	*migrated = true
+	return plaintext, nil
 }
 
-func (rs *RedisService) getObject(client *redis.Client, key string, obj interface{}) error {
-	data, err := client.Get(ctx, key).Result()
+// Prepara la clave de un registro nuevo: con clave maestra genera una clave
+// de datos y la guarda envuelta; sin ella se usa la clave del token.
+func (ah *AuthHandler) newRecordKey(account Account, info *EncryptedInfo) error {
+	if masterKeys == nil {
+		info.KeyID, info.DataKey, info.key = "", "", account.key
+		return nil
+	}
+
+	dataKey, err := kms.NewDataKey()
 	if err != nil {
-		return fmt.Errorf("error al obtener el valor de Redis: %v", err)
+		return &apiError{Code: "encryption_failed", Err: err}
 	}
-	return json.Unmarshal([]byte(data), obj)
+	keyID, wrapped, err := masterKeys.Wrap(ctx, dataKey)
+	if err != nil {
+		return &apiError{Code: "encryption_failed", Err: err}
+	}
+	key, err := ah.cryptoService.combineKeys(dataKey, account.key)
+	if err != nil {
+		return &apiError{Code: "encryption_failed", Err: err}
+	}
+
+	info.KeyID, info.DataKey, info.key = keyID, hex.EncodeToString(wrapped), key
+	return nil
 }
 
-// Handlers
-type AuthHandler struct {
-	emailService  *EmailService
-	cryptoService *CryptoService
-	redisService  *RedisService
-	client        *redis.Client
+// Desenvuelve la clave de datos de un registro guardado
+func (ah *AuthHandler) openRecordKey(account Account, info *EncryptedInfo) error {
+	if info.KeyID == "" {
+		info.key = account.key
+		return nil
+	}
+	if masterKeys == nil {
+		return &apiError{Code: "decryption_failed", Err: errors.New("el registro usa una clave maestra y no hay ninguna configurada")}
+	}
+
+	wrapped, err := hex.DecodeString(info.DataKey)
+	if err != nil {
+		return &apiError{Code: "decryption_failed", Err: err}
+	}
+	dataKey, err := masterKeys.Unwrap(ctx, info.KeyID, wrapped)
+	if err != nil {
+		return &apiError{Code: "decryption_failed", Err: err}
+	}
+	if info.key, err = ah.cryptoService.combineKeys(dataKey, account.key); err != nil {
+		return &apiError{Code: "decryption_failed", Err: err}
+	}
+	return nil
 }
 
-func (ah *AuthHandler) saveCredentials(c *gin.Context) {
-	var newCredential Credential
-	if err := c.BindJSON(&newCredential); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Datos inválidos"})
-		return
+// Intentos de una transacción con WATCH antes de desistir si otra solicitud
+// sigue modificando las mismas claves
+const maxWatchAttempts = 10
+
+var errWatchConflict = errors.New("las claves cambiaron en cada intento de la transacción")
+
+// Modifica el registro de la cuenta de forma atómica: lo vuelve a leer con
+// WATCH, desenvuelve su clave y le aplica update, que cifra con info.key los
+// campos que cambia. Así no se pisan los cambios de otra solicitud ni la clave
+// de datos que rotate-master-key haya vuelto a envolver mientras tanto.
+func (ah *AuthHandler) updateRecord(account Account, update func(info *EncryptedInfo) error) error {
+	key := accountKey(account.ID)
+	for range maxWatchAttempts {
+		err := ah.client.Watch(ctx, func(tx *redis.Tx) error {
+			data, err := tx.Get(ctx, key).Bytes()
+			if err != nil {
+				return &apiError{Code: "storage_error", Err: err}
+			}
+
+			var info EncryptedInfo
+			if err := json.Unmarshal(data, &info); err != nil {
+				return &apiError{Code: "invalid_credential", Err: err}
+			}
+			if err := ah.openRecordKey(account, &info); err != nil {
+				return err
+			}
+			if err := update(&info); err != nil {
+				return err
+			}
+
+			updated, err := json.Marshal(info)
+			if err != nil || bytes.Equal(updated, data) {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, updated, 0)
+				return nil
+			})
+			return err
+		}, key)
+
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		var apiErr *apiError
+		if err != nil && !errors.As(err, &apiErr) {
+			err = &apiError{Code: "storage_error", Err: err}
+		}
+		return err
 	}
+	return &apiError{Code: "storage_error", Err: errWatchConflict}
+}
 
-	// Generar token a partir de hash de la contraseña
-	data := []byte(newCredential.Password)
-	hash := sha3.Sum256(data)
-	token := fmt.Sprintf("%x", hash[:])
+// Vuelve a cifrar todos los campos del registro con otra clave
+func (ah *AuthHandler) reencrypt(info *EncryptedInfo, from, to []byte) error {
+	for _, field := range info.fields() {
+		if *field == "" {
+			continue
+		}
+		data, err := hex.DecodeString(*field)
+		if err == nil {
+			data, err = ah.cryptoService.decrypt(data, from)
+		}
+		if err != nil {
+			return &apiError{Code: "decryption_failed"}
+		}
+		encrypted, err := ah.cryptoService.encrypt(data, to)
+		if err != nil {
+			return &apiError{Code: "encryption_failed", Err: err}
+		}
+		*field = hex.EncodeToString(encrypted)
+	}
+	return nil
+}
 
-	// Enviar correo de prueba
-	if err := ah.emailService.sendWelcomeEmail(newCredential.Email, newCredential.Password, token); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+// Lee la solicitud de envío desde JSON o desde multipart/form-data (con los
+// archivos en el campo "attachments")
+func bindEmailRequest(c *gin.Context, request *EmailRequest) error {
+	if c.ContentType() != "multipart/form-data" {
+		return c.ShouldBindJSON(request)
 	}
 
-	// Encriptar credenciales
-	encryptedPassword, err := ah.cryptoService.encrypt([]byte(newCredential.Password), hash[:])
+	form, err := c.MultipartForm()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error al cifrar la contraseña"})
-		return
+		return err
 	}
 
-	encryptedEmail, err := ah.cryptoService.encrypt([]byte(newCredential.Email), hash[:])
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error al cifrar el email"})
-		return
+	request.FromName = c.PostForm("fromName")
+	request.To = c.PostFormArray("to")
+	request.Cc = c.PostFormArray("cc")
+	request.Bcc = c.PostFormArray("bcc")
+	request.Subject = c.PostForm("subject")
+	request.HtmlBody = c.PostForm("htmlBody")
+	request.TextBody = c.PostForm("textBody")
+	request.TLSPolicy = mailer.TLSPolicy(c.PostForm("tlsPolicy"))
+	request.ReplyTo = c.PostFormArray("replyTo")
+	request.InReplyTo = c.PostForm("inReplyTo")
+	request.References = c.PostFormArray("references")
+	request.Headers = c.PostFormMap("headers")
+	request.TemplateID = c.PostForm("templateId")
+	request.DryRun, _ = strconv.ParseBool(c.PostForm("dryRun"))
+	request.Async, _ = strconv.ParseBool(c.PostForm("async"))
+
+	if variables := c.PostFormMap("variables"); len(variables) > 0 {
+		request.Variables = map[string]any{}
+		for k, v := range variables {
+			request.Variables[k] = v
+		}
 	}
 
-	// Guardar en Redis
-	newInfoData := EncryptedInfo{
-		Key:   fmt.Sprintf("%x", encryptedPassword),
-		Value: fmt.Sprintf("%x", encryptedEmail),
+	// Los archivos del campo "inline" se referencian desde el HTML por su nombre (cid:logo.png)
+	for _, field := range []string{"attachments", "inline"} {
+		for _, fileHeader := range form.File[field] {
+			attachment, err := readFormAttachment(fileHeader)
+			if err != nil {
+				return err
+			}
+			if field == "inline" {
+				attachment.ContentID = fileHeader.Filename
+			}
+			request.Attachments = append(request.Attachments, attachment)
+		}
 	}
 
-	if err := ah.redisService.saveObject(ah.client, token, newInfoData); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	return nil
+}
+
+// Lee la solicitud de envío masivo desde JSON o desde multipart/form-data
+// (con el CSV en el campo "csv")
+func bindBulkRequest(c *gin.Context, request *BulkRequest) error {
+	if c.ContentType() != "multipart/form-data" {
+		return c.ShouldBindJSON(request)
 	}
 
-	c.JSON(http.StatusCreated, gin.H{
-		"token":   token,
-		"message": "Te recomendamos guardar bien el token",
-	})
+	request.FromName = c.PostForm("fromName")
+	request.Subject = c.PostForm("subject")
+	request.HtmlBody = c.PostForm("htmlBody")
+	request.TextBody = c.PostForm("textBody")
+	request.TemplateID = c.PostForm("templateId")
+	request.EmailColumn = c.PostForm("emailColumn")
+	request.TLSPolicy = mailer.TLSPolicy(c.PostForm("tlsPolicy"))
+
+	fileHeader, err := c.FormFile("csv")
+	if err != nil {
+		return &mailer.Error{Code: mailer.CodeInvalidCSV, Message: "falta el archivo csv"}
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	request.CSV = string(data)
+	return nil
 }
 
-func (ah *AuthHandler) sendEmailHandler(c *gin.Context) {
-	// Validar el encabezado de autorización
-	authHeader := c.GetHeader("Authorization")
-	if authHeader == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing Authorization header"})
-		return
+// Lee un archivo subido por formulario como adjunto
+func readFormAttachment(fileHeader *multipart.FileHeader) (mailer.Attachment, error) {
+	// Los archivos demasiado grandes se rechazan sin leerlos
+	if fileHeader.Size > mailer.MaxAttachmentSize {
+		return mailer.Attachment{}, &mailer.Error{
+			Code:    mailer.CodeAttachmentTooLarge,
+			Message: fmt.Sprintf("el adjunto %s supera el máximo de %d MB", fileHeader.Filename, mailer.MaxAttachmentSize>>20),
+		}
 	}
 
-	parts := strings.Fields(authHeader)
-	if len(parts) != 2 || parts[0] != "Bearer" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid Authorization header format"})
-		return
+	file, err := fileHeader.Open()
+	if err != nil {
+		return mailer.Attachment{}, err
 	}
+	defer file.Close()
 
-	token := parts[1]
-	tokenBytes, err := hex.DecodeString(token)
+	content, err := io.ReadAll(file)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Token inválido"})
-		return
+		return mailer.Attachment{}, err
 	}
 
-	// Parsear la solicitud
-	var request EmailRequest
-	if err := c.ShouldBindJSON(&request); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Error al leer el cuerpo de la solicitud"})
-		return
+	return mailer.Attachment{
+		Filename:    fileHeader.Filename,
+		ContentType: fileHeader.Header.Get("Content-Type"),
+		Content:     content,
+	}, nil
+}
+
+// Completa la solicitud con la plantilla indicada en templateId. El asunto de
+// la solicitud, si viene, tiene prioridad sobre el de la plantilla.
+func (ah *AuthHandler) applyTemplate(accountID string, request *EmailRequest) error {
+	if request.HtmlBody != "" || request.TextBody != "" {
+		return &mailer.Error{Code: mailer.CodeInvalidTemplate, Message: "templateId no se puede combinar con htmlBody ni textBody"}
 	}
 
-	// Obtener credenciales encriptadas de Redis
-	var dataCredential EncryptedInfo
-	if err := ah.redisService.getObject(ah.client, token, &dataCredential); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	tmpl, err := ah.getTemplate(accountID, request.TemplateID)
+	if err != nil {
+		return err
 	}
 
-	// Desencriptar contraseña
-	encryptedPasswordBytes, err := hex.DecodeString(dataCredential.Key)
+	rendered, err := tmpl.Render(request.Variables)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error procesando credenciales"})
-		return
+		return err
+	}
+
+	if request.Subject == "" {
+		request.Subject = rendered.Subject
 	}
+	request.HtmlBody = rendered.HtmlBody
+	request.TextBody = rendered.TextBody
+	return nil
+}
 
-	decryptedPassword, err := ah.cryptoService.decrypt(encryptedPasswordBytes, tokenBytes)
+// Cifra los datos OAuth de una credencial
+func (ah *AuthHandler) encryptGrant(grant OAuthGrant, key []byte) (string, error) {
+	data, err := json.Marshal(grant)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error al desencriptar la contraseña"})
-		return
+		return "", err
 	}
 
-	// Desencriptar email
-	encryptedEmailBytes, err := hex.DecodeString(dataCredential.Value)
+	encrypted, err := ah.cryptoService.encrypt(data, key)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error procesando credenciales"})
+		return "", err
+	}
+	return fmt.Sprintf("%x", encrypted), nil
+}
+
+// Responde los errores de plantillas: 404 si no existe, 400 si no compila o
+// le faltan variables
+func sendTemplateError(c *gin.Context, err error) {
+	var mailErr *mailer.Error
+	if !errors.As(err, &mailErr) {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if mailErr.Code == mailer.CodeTemplateNotFound {
+		sendError(c, http.StatusNotFound, err)
 		return
 	}
+	sendError(c, http.StatusBadRequest, err)
+}
 
-	decryptedEmail, err := ah.cryptoService.decrypt(encryptedEmailBytes, tokenBytes)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error al desencriptar el email"})
+// Error de la API con un código estable. El mensaje para el cliente se toma
+// del catálogo; Err es el detalle técnico, si lo hay.
+type apiError struct {
+	Code string
+	Err  error
+}
+
+func (e *apiError) Error() string {
+	if e.Err != nil {
+		return i18n.T(i18n.Default, e.Code) + ": " + e.Err.Error()
+	}
+	return i18n.T(i18n.Default, e.Code)
+}
+
+func (e *apiError) Unwrap() error {
+	return e.Err
+}
+
+// Clave del contexto de gin con el idioma elegido en la solicitud
+const langKey = "lang"
+
+// Idioma de la respuesta: el fijado en la solicitud (por ejemplo el campo
+// locale del registro) o el que pida Accept-Language
+func lang(c *gin.Context) i18n.Lang {
+	if l, ok := c.Get(langKey); ok {
+		return l.(i18n.Lang)
+	}
+	return i18n.Negotiate(c.GetHeader("Accept-Language"))
+}
+
+// Responde un error con su código estable y el mensaje en el idioma del cliente
+func respondError(c *gin.Context, status int, code string, args ...any) {
+	c.JSON(status, gin.H{"error": i18n.T(lang(c), code, args...), "code": code})
+}
+
+// Responde un error de la API o de envío. El código de mailer.Error sirve
+// también de clave en el catálogo; su mensaje queda como detalle.
+func sendError(c *gin.Context, status int, err error) {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		response := gin.H{"error": i18n.T(lang(c), apiErr.Code), "code": apiErr.Code}
+		if apiErr.Err != nil {
+			response["detail"] = apiErr.Err.Error()
+		}
+		c.JSON(status, response)
 		return
 	}
 
-	// Enviar correo
-	if err := ah.emailService.send(
-		string(decryptedEmail),
-		string(decryptedPassword),
-		request.To,
-		request.Subject,
-		request.HtmlBody,
-	); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	var mailErr *mailer.Error
+	if errors.As(err, &mailErr) {
+		c.JSON(status, gin.H{"error": i18n.T(lang(c), mailErr.Code), "code": mailErr.Code, "detail": mailErr.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Correo electrónico enviado exitosamente"})
+	c.JSON(status, gin.H{"error": i18n.T(lang(c), "internal_error"), "code": "internal_error", "detail": err.Error()})
 }
 func (ah *AuthHandler) serveIndexPage(c *gin.Context) {
 	htmlContent := `
@@ -1066,6 +3903,8 @@ Content-Type: application/json</code></pre>
 
 // Modificación del handler para Vercel
 func Handler(w http.ResponseWriter, r *http.Request) {
+	setupOnce.Do(setup)
+
 	// Configurar Gin en modo de producción
 	gin.SetMode(gin.ReleaseMode)
 
@@ -1074,7 +3913,11 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	router.Use(gin.Recovery())
 
 	// Servicios
-	emailService := &EmailService{}
+	emailService := &EmailService{
+		newTransport: func(server mailer.Server, login mailer.Login) mailer.Transport {
+			return mailer.NewSMTPTransport(server, login, tlsOptions)
+		},
+	}
 	cryptoService := &CryptoService{}
 	redisService := &RedisService{}
 
@@ -1086,9 +3929,31 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		client:        redisClient,
 	}
 
+	// Permisos por ruta
+	send := authHandler.requireScope(scopeSend)
+	templatesRead := authHandler.requireScope(scopeTemplatesRead)
+	templatesWrite := authHandler.requireScope(scopeTemplatesWrite)
+	logsRead := authHandler.requireScope(scopeLogsRead)
+	admin := authHandler.requireScope(scopeAdmin)
+
 	// Rutas
 	router.POST("/credential/register", authHandler.saveCredentials)
-	router.POST("/send-email", authHandler.sendEmailHandler)
+	router.PUT("/credential/dkim", admin, authHandler.saveDKIMKey)
+	router.GET("/keys", admin, authHandler.listAPIKeys)
+	router.POST("/keys", admin, authHandler.createAPIKey)
+	router.DELETE("/keys/:id", admin, authHandler.revokeAPIKey)
+	router.POST("/send-email", send, authHandler.sendEmailHandler)
+	router.GET("/messages/dead", logsRead, authHandler.listDeadLetters)
+	router.GET("/messages/:id", logsRead, authHandler.messageStatusHandler)
+	router.POST("/messages/:id/replay", send, authHandler.replayDeadLetter)
+	router.GET("/queue/drain", authHandler.drainQueueHandler)
+	router.POST("/send-bulk", send, authHandler.sendBulkHandler)
+	router.GET("/send-bulk/:id", logsRead, authHandler.bulkReportHandler)
+	router.GET("/templates", templatesRead, authHandler.listTemplates)
+	router.POST("/templates", templatesWrite, authHandler.createTemplate)
+	router.GET("/templates/:id", templatesRead, authHandler.getTemplateHandler)
+	router.PUT("/templates/:id", templatesWrite, authHandler.updateTemplate)
+	router.DELETE("/templates/:id", templatesWrite, authHandler.deleteTemplate)
 	router.GET("/", authHandler.serveIndexPage)
 
 	// Manejar solicitud
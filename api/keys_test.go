@@ -0,0 +1,367 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Handler con el Redis de prueba y sin clave maestra
+func newTestHandler(t *testing.T) (*AuthHandler, *testRedis) {
+	t.Helper()
+
+	secret := tokenSecret
+	tokenSecret = []byte("sal de prueba")
+	t.Cleanup(func() { tokenSecret = secret })
+	gin.SetMode(gin.TestMode)
+
+	store := &testRedis{}
+	ah := &AuthHandler{
+		cryptoService: &CryptoService{},
+		redisService:  &RedisService{},
+		client:        store.start(t),
+	}
+	return ah, store
+}
+
+func newTestAccount(t *testing.T) Account {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return Account{ID: newID(), key: key}
+}
+
+func newTestToken(t *testing.T) (string, []byte) {
+	t.Helper()
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(tokenBytes), tokenBytes
+}
+
+// Crea una clave de API de la cuenta y devuelve también su token
+func addAPIKey(t *testing.T, ah *AuthHandler, account Account, scopes ...string) (APIKey, string) {
+	t.Helper()
+	token, tokenBytes := newTestToken(t)
+	key := newAPIKey("prueba", scopes, token)
+	if err := ah.saveAPIKey(account, &key, tokenBytes); err != nil {
+		t.Fatal(err)
+	}
+	return key, token
+}
+
+// Hace la solicitud y devuelve el estado y el código de error de la respuesta
+func serve(t *testing.T, router http.Handler, method, path, authorization string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("respuesta inválida %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, body.Code
+}
+
+func TestRequireScope(t *testing.T) {
+	ah, store := newTestHandler(t)
+	account := newTestAccount(t)
+	sendKey, sendToken := addAPIKey(t, ah, account, scopeSend)
+	_, adminToken := addAPIKey(t, ah, account, scopeAdmin)
+	unknownToken, _ := newTestToken(t)
+
+	tests := []struct {
+		name          string
+		authorization string
+		scope         string
+		status        int
+		code          string
+	}{
+		{name: "sin cabecera", scope: scopeSend, status: http.StatusUnauthorized, code: "missing_authorization"},
+		{name: "otro esquema", authorization: "Basic " + sendToken, scope: scopeSend, status: http.StatusUnauthorized, code: "invalid_authorization"},
+		{name: "token no hexadecimal", authorization: "Bearer token", scope: scopeSend, status: http.StatusBadRequest, code: "invalid_token"},
+		{name: "token desconocido", authorization: "Bearer " + unknownToken, scope: scopeSend, status: http.StatusUnauthorized, code: "unknown_token"},
+		{name: "sin el permiso", authorization: "Bearer " + sendToken, scope: scopeAdmin, status: http.StatusForbidden, code: "insufficient_scope"},
+		{
+			// admin no incluye los demás permisos
+			name:          "admin en una ruta de envío",
+			authorization: "Bearer " + adminToken,
+			scope:         scopeSend,
+			status:        http.StatusForbidden,
+			code:          "insufficient_scope",
+		},
+		{name: "con el permiso", authorization: "Bearer " + sendToken, scope: scopeSend, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.GET("/", ah.requireScope(tt.scope), func(c *gin.Context) {
+				account := currentAccount(c)
+				c.JSON(http.StatusOK, gin.H{"account": account.ID, "key": account.apiKey.ID})
+			})
+
+			status, code := serve(t, router, http.MethodGet, "/", tt.authorization)
+			if status != tt.status || code != tt.code {
+				t.Errorf("respuesta = %d %q, se esperaba %d %q", status, code, tt.status, tt.code)
+			}
+		})
+	}
+
+	// La solicitud autorizada deja registrado el último uso de la clave
+	data, ok := store.hget(apiKeysKey(account.ID), sendKey.ID)
+	if !ok {
+		t.Fatal("la clave de API ya no está guardada")
+	}
+	var stored APIKey
+	if err := json.Unmarshal([]byte(data), &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.LastUsedAt == nil {
+		t.Error("no se guardó el último uso de la clave")
+	}
+}
+
+func TestResolveAccount(t *testing.T) {
+	tests := []struct {
+		name string
+		// Guarda lo necesario y devuelve el token y la cuenta esperada
+		setup func(t *testing.T, ah *AuthHandler, store *testRedis) ([]byte, Account)
+		code  string
+	}{
+		{
+			name: "clave con permisos",
+			setup: func(t *testing.T, ah *AuthHandler, store *testRedis) ([]byte, Account) {
+				account := newTestAccount(t)
+				key, token := addAPIKey(t, ah, account, scopeSend)
+				tokenBytes, _ := hex.DecodeString(token)
+				account.apiKey = key
+				return tokenBytes, account
+			},
+		},
+		{
+			// Cuenta anterior a las claves de API: el índice solo tiene su id
+			// y la clave de la cuenta es la derivada del token
+			name: "clave principal",
+			setup: func(t *testing.T, ah *AuthHandler, store *testRedis) ([]byte, Account) {
+				_, tokenBytes := newTestToken(t)
+				derived, err := ah.cryptoService.deriveKey(tokenBytes)
+				if err != nil {
+					t.Fatal(err)
+				}
+				account := Account{ID: newID(), key: derived}
+				if err := ah.client.Set(ctx, tokenIndexKey(tokenHash(tokenBytes)), account.ID, 0).Err(); err != nil {
+					t.Fatal(err)
+				}
+				account.apiKey = APIKey{ID: tokenHash(tokenBytes)[:16], Scopes: allScopes}
+				return tokenBytes, account
+			},
+		},
+		{
+			name: "clave revocada",
+			setup: func(t *testing.T, ah *AuthHandler, store *testRedis) ([]byte, Account) {
+				account := newTestAccount(t)
+				key, token := addAPIKey(t, ah, account, scopeSend)
+				if err := ah.client.HDel(ctx, apiKeysKey(account.ID), key.ID).Err(); err != nil {
+					t.Fatal(err)
+				}
+				tokenBytes, _ := hex.DecodeString(token)
+				return tokenBytes, Account{}
+			},
+			code: "unknown_token",
+		},
+		{
+			name: "token desconocido",
+			setup: func(t *testing.T, ah *AuthHandler, store *testRedis) ([]byte, Account) {
+				_, tokenBytes := newTestToken(t)
+				return tokenBytes, Account{}
+			},
+			code: "unknown_token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ah, store := newTestHandler(t)
+			tokenBytes, want := tt.setup(t, ah, store)
+
+			account, err := ah.resolveAccount(hex.EncodeToString(tokenBytes), tokenBytes)
+			if tt.code != "" {
+				var apiErr *apiError
+				if !errors.As(err, &apiErr) || apiErr.Code != tt.code {
+					t.Fatalf("resolveAccount = %v, se esperaba %s", err, tt.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if account.ID != want.ID || !bytes.Equal(account.key, want.key) {
+				t.Errorf("cuenta = %s, se esperaba %s con su clave", account.ID, want.ID)
+			}
+			if account.apiKey.ID != want.apiKey.ID || len(account.apiKey.Scopes) != len(want.apiKey.Scopes) {
+				t.Errorf("clave de API = %s %v, se esperaba %s %v", account.apiKey.ID, account.apiKey.Scopes, want.apiKey.ID, want.apiKey.Scopes)
+			}
+
+			// El índice queda apuntando a la clave de API
+			index, _ := store.get(tokenIndexKey(tokenHash(tokenBytes)))
+			if index != want.ID+":"+want.apiKey.ID {
+				t.Errorf("índice del token = %q, se esperaba %q", index, want.ID+":"+want.apiKey.ID)
+			}
+		})
+	}
+}
+
+func TestResolveLegacyAccount(t *testing.T) {
+	ah, store := newTestHandler(t)
+
+	// Antes la cuenta se guardaba bajo el token, cifrada con sus bytes
+	token, tokenBytes := newTestToken(t)
+	encrypted, err := ah.cryptoService.encrypt([]byte("usuario@example.com"), tokenBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ah.redisService.saveObject(ah.client, token, EncryptedInfo{Key: hex.EncodeToString(encrypted)}); err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := ah.resolveAccount(token, tokenBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.get(token); ok {
+		t.Error("la cuenta sigue guardada bajo el token")
+	}
+
+	// El registro pasa al id nuevo cifrado con la clave derivada
+	var info EncryptedInfo
+	if err := ah.redisService.getObject(ah.client, accountKey(account.ID), &info); err != nil {
+		t.Fatal(err)
+	}
+	derived, err := ah.cryptoService.deriveKey(tokenBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrated := false
+	plaintext, err := ah.decryptField(&info.Key, derived, &migrated)
+	if err != nil || string(plaintext) != "usuario@example.com" {
+		t.Errorf("campo migrado = %q, %v", plaintext, err)
+	}
+	if !account.apiKey.allows(scopeAdmin) {
+		t.Error("la clave principal no tiene todos los permisos")
+	}
+}
+
+func TestRevokeAPIKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		admins int    // claves admin de la cuenta, además de una de envío
+		revoke string // "send", "self", "other" o un id inexistente
+		status int
+		code   string
+	}{
+		{name: "clave de envío", admins: 1, revoke: "send", status: http.StatusOK},
+		{name: "otra clave admin", admins: 2, revoke: "other", status: http.StatusOK},
+		{name: "la propia clave", admins: 2, revoke: "self", status: http.StatusOK},
+		{name: "última clave admin", admins: 1, revoke: "self", status: http.StatusConflict, code: "last_admin_key"},
+		{name: "no existe", admins: 1, revoke: "0000000000000000", status: http.StatusNotFound, code: "api_key_not_found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ah, store := newTestHandler(t)
+			router := gin.New()
+			router.DELETE("/keys/:id", ah.requireScope(scopeAdmin), ah.revokeAPIKey)
+
+			account := newTestAccount(t)
+			keys := map[string]APIKey{}
+			tokens := map[string]string{}
+			keys["send"], tokens["send"] = addAPIKey(t, ah, account, scopeSend)
+			keys["self"], tokens["self"] = addAPIKey(t, ah, account, scopeAdmin)
+			if tt.admins > 1 {
+				keys["other"], tokens["other"] = addAPIKey(t, ah, account, scopeAdmin)
+			}
+
+			id := tt.revoke
+			if key, ok := keys[tt.revoke]; ok {
+				id = key.ID
+			}
+			status, code := serve(t, router, http.MethodDelete, "/keys/"+id, "Bearer "+tokens["self"])
+			if status != tt.status || code != tt.code {
+				t.Fatalf("respuesta = %d %q, se esperaba %d %q", status, code, tt.status, tt.code)
+			}
+
+			key, ok := keys[tt.revoke]
+			if !ok {
+				return
+			}
+			_, stored := store.hget(apiKeysKey(account.ID), key.ID)
+			_, indexed := store.get(tokenIndexKey(key.TokenHash))
+			if revoked := status == http.StatusOK; stored == revoked || indexed == revoked {
+				t.Errorf("guardada = %v, indexada = %v; se esperaba revocada = %v", stored, indexed, revoked)
+			}
+
+			// El token revocado deja de autenticar al instante
+			if status == http.StatusOK {
+				status, code = serve(t, router, http.MethodDelete, "/keys/"+id, "Bearer "+tokens[tt.revoke])
+				if status != http.StatusUnauthorized || code != "unknown_token" {
+					t.Errorf("token revocado = %d %q, se esperaba 401 unknown_token", status, code)
+				}
+			}
+		})
+	}
+}
+
+// Dos revocaciones simultáneas de las dos únicas claves admin: solo puede
+// terminar una, la otra debe encontrarse con la última clave admin
+func TestRevokeLastAdminConcurrent(t *testing.T) {
+	ah, store := newTestHandler(t)
+
+	for range 20 {
+		account := newTestAccount(t)
+		first, _ := addAPIKey(t, ah, account, scopeAdmin)
+		second, _ := addAPIKey(t, ah, account, scopeAdmin)
+
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		for i, key := range []APIKey{first, second} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = ah.deleteAPIKey(account.ID, key.ID)
+			}()
+		}
+		wg.Wait()
+
+		revoked := 0
+		for _, err := range errs {
+			var apiErr *apiError
+			switch {
+			case err == nil:
+				revoked++
+			case !errors.As(err, &apiErr) || apiErr.Code != "last_admin_key":
+				t.Fatalf("deleteAPIKey = %v", err)
+			}
+		}
+		_, firstStored := store.hget(apiKeysKey(account.ID), first.ID)
+		_, secondStored := store.hget(apiKeysKey(account.ID), second.ID)
+		if revoked != 1 || firstStored == secondStored {
+			t.Fatalf("se revocaron %d claves, quedan la primera = %v y la segunda = %v", revoked, firstStored, secondStored)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Servidor Redis mínimo en proceso con los comandos de cadenas y hashes que
+// usan las claves de API y las transacciones con WATCH. Cada escritura
+// incrementa la versión de su clave y EXEC falla si cambió alguna vigilada.
+type testRedis struct {
+	mu       sync.Mutex
+	strings  map[string]string
+	hashes   map[string]map[string]string
+	versions map[string]int
+}
+
+func (r *testRedis) start(t *testing.T) *redis.Client {
+	t.Helper()
+
+	r.strings = map[string]string{}
+	r.hashes = map[string]map[string]string{}
+	r.versions = map[string]int{}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+
+	client := redis.NewClient(&redis.Options{Addr: ln.Addr().String()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func (r *testRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	var queued [][]string // comandos entre MULTI y EXEC
+	var watched map[string]int
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "WATCH":
+			r.mu.Lock()
+			if watched == nil {
+				watched = map[string]int{}
+			}
+			for _, key := range args[1:] {
+				watched[key] = r.versions[key]
+			}
+			r.mu.Unlock()
+			reply = "+OK\r\n"
+		case cmd == "UNWATCH":
+			watched = nil
+			reply = "+OK\r\n"
+		case cmd == "MULTI":
+			queued = [][]string{}
+			reply = "+OK\r\n"
+		case cmd == "DISCARD":
+			queued, watched = nil, nil
+			reply = "+OK\r\n"
+		case cmd == "EXEC":
+			r.mu.Lock()
+			reply = fmt.Sprintf("*%d\r\n", len(queued))
+			for key, version := range watched {
+				if r.versions[key] != version {
+					reply = "*-1\r\n"
+				}
+			}
+			if reply != "*-1\r\n" {
+				for _, args := range queued {
+					reply += r.exec(args)
+				}
+			}
+			r.mu.Unlock()
+			queued, watched = nil, nil
+		case queued != nil:
+			queued = append(queued, args)
+			reply = "+QUEUED\r\n"
+		default:
+			r.mu.Lock()
+			reply = r.exec(args)
+			r.mu.Unlock()
+		}
+
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// Lee un comando en el formato RESP: un arreglo de cadenas
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		if line, err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func bulkString(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func bulkArray(items []string) string {
+	reply := fmt.Sprintf("*%d\r\n", len(items))
+	for _, item := range items {
+		reply += bulkString(item)
+	}
+	return reply
+}
+
+const nilReply = "$-1\r\n"
+
+// Ejecuta un comando con r.mu tomado
+func (r *testRedis) exec(args []string) string {
+	cmd := strings.ToUpper(args[0])
+	switch cmd {
+	case "SET", "SETNX", "EXPIRE", "HSET", "HDEL":
+		r.versions[args[1]]++
+	case "DEL", "RENAME":
+		for _, key := range args[1:] {
+			r.versions[key]++
+		}
+	}
+
+	switch cmd {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		value, ok := r.strings[args[1]]
+		if !ok {
+			return nilReply
+		}
+		return bulkString(value)
+	case "SET":
+		nx := false
+		for _, option := range args[3:] {
+			nx = nx || strings.EqualFold(option, "NX")
+		}
+		if _, exists := r.strings[args[1]]; exists && nx {
+			return nilReply
+		}
+		r.strings[args[1]] = args[2]
+		return "+OK\r\n"
+	case "SETNX":
+		if _, exists := r.strings[args[1]]; exists {
+			return ":0\r\n"
+		}
+		r.strings[args[1]] = args[2]
+		return ":1\r\n"
+	case "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			if r.exists(key) {
+				n++
+			}
+			delete(r.strings, key)
+			delete(r.hashes, key)
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "EXISTS":
+		n := 0
+		for _, key := range args[1:] {
+			if r.exists(key) {
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "EXPIRE":
+		if !r.exists(args[1]) {
+			return ":0\r\n"
+		}
+		return ":1\r\n"
+	case "RENAME":
+		if value, ok := r.strings[args[1]]; ok {
+			r.strings[args[2]] = value
+		} else if hash, ok := r.hashes[args[1]]; ok {
+			r.hashes[args[2]] = hash
+		} else {
+			return "-ERR no such key\r\n"
+		}
+		delete(r.strings, args[1])
+		delete(r.hashes, args[1])
+		return "+OK\r\n"
+	case "SCAN":
+		pattern := "*"
+		for i := 2; i+1 < len(args); i++ {
+			if strings.EqualFold(args[i], "MATCH") {
+				pattern = args[i+1]
+			}
+		}
+		var keys []string
+		for key := range r.strings {
+			if ok, _ := path.Match(pattern, key); ok {
+				keys = append(keys, key)
+			}
+		}
+		for key := range r.hashes {
+			if ok, _ := path.Match(pattern, key); ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		return "*2\r\n" + bulkString("0") + bulkArray(keys)
+	case "HSET":
+		hash := r.hashes[args[1]]
+		if hash == nil {
+			hash = map[string]string{}
+			r.hashes[args[1]] = hash
+		}
+		n := 0
+		for i := 2; i+1 < len(args); i += 2 {
+			if _, ok := hash[args[i]]; !ok {
+				n++
+			}
+			hash[args[i]] = args[i+1]
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "HGET":
+		value, ok := r.hashes[args[1]][args[2]]
+		if !ok {
+			return nilReply
+		}
+		return bulkString(value)
+	case "HGETALL":
+		var fields []string
+		for field, value := range r.hashes[args[1]] {
+			fields = append(fields, field, value)
+		}
+		return bulkArray(fields)
+	case "HDEL":
+		n := 0
+		for _, field := range args[2:] {
+			if _, ok := r.hashes[args[1]][field]; ok {
+				delete(r.hashes[args[1]], field)
+				n++
+			}
+		}
+		if len(r.hashes[args[1]]) == 0 {
+			delete(r.hashes, args[1])
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	}
+	return "-ERR comando no soportado " + cmd + "\r\n"
+}
+
+func (r *testRedis) exists(key string) bool {
+	_, isString := r.strings[key]
+	_, isHash := r.hashes[key]
+	return isString || isHash
+}
+
+// Copia de lo guardado para revisarlo en las pruebas
+func (r *testRedis) get(key string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	value, ok := r.strings[key]
+	return value, ok
+}
+
+func (r *testRedis) hget(key, field string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	value, ok := r.hashes[key][field]
+	return value, ok
+}
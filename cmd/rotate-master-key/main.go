@@ -0,0 +1,167 @@
+// rotate-master-key vuelve a envolver con la clave maestra activa las claves
+// de datos de todas las cuentas. No necesita los tokens de los usuarios: los
+// campos cifrados no cambian, solo la clave de datos envuelta.
+//
+// Uso, con las mismas variables de entorno que la API:
+//
+//	REDIS_URL=... MASTER_KEY_FILE=keys.json go run ./cmd/rotate-master-key
+//
+// Al terminar vuelve a recorrer las cuentas para comprobar que ninguna siga
+// usando una clave anterior. Cuando termina sin errores ni pendientes, las
+// claves maestras anteriores se pueden quitar del archivo.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+
+	"mailapi/kms"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Campos del registro de la cuenta que toca la rotación; el resto se
+// conserva tal cual
+type envelope struct {
+	KeyID   string `json:"keyId"`
+	DataKey string `json:"dataKey"`
+}
+
+func main() {
+	ctx := context.Background()
+
+	opt, err := redis.ParseURL(os.Getenv("REDIS_URL"))
+	if err != nil {
+		log.Fatalf("Error al parsear la URL de Redis: %v", err)
+	}
+	client := redis.NewClient(opt)
+
+	var keyring *kms.Keyring
+	if path := os.Getenv("MASTER_KEY_FILE"); path != "" {
+		keyring, err = kms.LoadKeyring(path)
+	} else {
+		keyring, err = kms.ParseKeyring([]byte(os.Getenv("MASTER_KEYS")))
+	}
+	if err != nil {
+		log.Fatalf("Error en las claves maestras: %v", err)
+	}
+
+	rotated, current, failed := 0, 0, 0
+	iter := client.Scan(ctx, 0, "account:*", 100).Iterator()
+	for iter.Next(ctx) {
+		changed, err := rotate(ctx, client, keyring, iter.Val())
+		switch {
+		case err != nil:
+			log.Println("Error rotando", iter.Val(), ":", err)
+			failed++
+		case changed:
+			rotated++
+		default:
+			current++
+		}
+	}
+	if err := iter.Err(); err != nil {
+		log.Fatalf("Error recorriendo las cuentas: %v", err)
+	}
+
+	pending, err := verify(ctx, client, keyring.KeyID())
+	if err != nil {
+		log.Fatalf("Error verificando las cuentas: %v", err)
+	}
+
+	log.Printf("Clave activa %s: %d rotadas, %d ya al día, %d con error, %d pendientes", keyring.KeyID(), rotated, current, failed, pending)
+	if failed > 0 || pending > 0 {
+		log.Println("No quites las claves anteriores todavía: vuelve a ejecutar la rotación")
+		os.Exit(1)
+	}
+}
+
+// Cuenta los registros que siguen envueltos con una clave distinta de la
+// activa, por ejemplo porque una versión anterior de la API los guardó
+// mientras se rotaban
+func verify(ctx context.Context, client *redis.Client, active string) (int, error) {
+	pending := 0
+	iter := client.Scan(ctx, 0, "account:*", 100).Iterator()
+	for iter.Next(ctx) {
+		data, err := client.Get(ctx, iter.Val()).Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return pending, err
+		}
+
+		var env envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			return pending, err
+		}
+		if env.KeyID != "" && env.KeyID != active {
+			log.Println("Sigue usando la clave", env.KeyID, ":", iter.Val())
+			pending++
+		}
+	}
+	return pending, iter.Err()
+}
+
+// Intentos de rotar una cuenta que la API sigue modificando
+const maxAttempts = 10
+
+// Rota la clave de datos de una cuenta. La transacción falla si la API
+// modifica el registro mientras tanto y se reintenta hasta maxAttempts veces.
+func rotate(ctx context.Context, client *redis.Client, k kms.KMS, key string) (bool, error) {
+	for range maxAttempts {
+		changed := false
+		err := client.Watch(ctx, func(tx *redis.Tx) error {
+			data, err := tx.Get(ctx, key).Bytes()
+			if err != nil {
+				return err
+			}
+
+			var record map[string]json.RawMessage
+			var env envelope
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			if err := json.Unmarshal(data, &env); err != nil {
+				return err
+			}
+			// Los registros sin clave de datos se migran al usarse
+			if env.KeyID == "" {
+				return nil
+			}
+
+			wrapped, err := hex.DecodeString(env.DataKey)
+			if err != nil {
+				return err
+			}
+			keyID, rewrapped, ok, err := kms.Rewrap(ctx, k, env.KeyID, wrapped)
+			if err != nil || !ok {
+				return err
+			}
+
+			record["keyId"], _ = json.Marshal(keyID)
+			record["dataKey"], _ = json.Marshal(hex.EncodeToString(rewrapped))
+			data, err = json.Marshal(record)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, data, redis.KeepTTL)
+				return nil
+			})
+			changed = err == nil
+			return err
+		}, key)
+
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		return changed, err
+	}
+	return false, errors.New("el registro cambió en cada intento")
+}
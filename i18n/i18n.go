@@ -0,0 +1,86 @@
+// Package i18n contiene el catálogo de mensajes de la API en los idiomas
+// soportados. Los mensajes se buscan por una clave estable, que es también
+// el código de error que ven los clientes.
+package i18n
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Lang es un idioma soportado (código ISO 639-1).
+type Lang string
+
+const (
+	Spanish Lang = "es"
+	English Lang = "en"
+)
+
+// Default es el idioma cuando el cliente no pide ninguno soportado.
+const Default = Spanish
+
+// Parse reconoce una etiqueta de idioma ("en", "en-US", "es_MX"...).
+func Parse(tag string) (Lang, bool) {
+	base, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+	base, _, _ = strings.Cut(base, "_")
+
+	switch Lang(base) {
+	case Spanish, English:
+		return Lang(base), true
+	}
+	return "", false
+}
+
+// Negotiate elige el idioma a partir de un encabezado Accept-Language,
+// respetando los pesos q.
+func Negotiate(acceptLanguage string) Lang {
+	type candidate struct {
+		lang Lang
+		q    float64
+	}
+
+	var candidates []candidate
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+
+		if lang, ok := Parse(tag); ok && q > 0 {
+			candidates = append(candidates, candidate{lang, q})
+		}
+	}
+
+	if len(candidates) == 0 {
+		return Default
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	return candidates[0].lang
+}
+
+// T devuelve el mensaje de key en el idioma pedido, con los argumentos
+// aplicados como en fmt.Sprintf. Si falta la traducción usa el idioma por
+// defecto y, en último caso, la propia clave.
+func T(lang Lang, key string, args ...any) string {
+	translations, ok := catalog[key]
+	if !ok {
+		return key
+	}
+
+	format, ok := translations[lang]
+	if !ok {
+		format = translations[Default]
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
@@ -0,0 +1,275 @@
+package i18n
+
+// catalog asocia cada clave con su texto en cada idioma. Las claves de error
+// coinciden con los códigos de mailer (invalid_address, tls_required...).
+var catalog = map[string]map[Lang]string{
+	// Respuestas correctas
+	"token_created": {
+		Spanish: "Te recomendamos guardar bien el token",
+		English: "We recommend keeping the token somewhere safe",
+	},
+	"email_sent": {
+		Spanish: "Correo electrónico enviado exitosamente",
+		English: "Email sent successfully",
+	},
+	"dry_run": {
+		Spanish: "Simulación: el correo no se envió",
+		English: "Dry run: the email was not sent",
+	},
+	"dkim_saved": {
+		Spanish: "Clave DKIM guardada",
+		English: "DKIM key saved",
+	},
+	"email_queued": {
+		Spanish: "Correo encolado para su envío",
+		English: "Email queued for delivery",
+	},
+	"api_key_created": {
+		Spanish: "Clave de API creada; guarda el token, no se volverá a mostrar",
+		English: "API key created; store the token, it will not be shown again",
+	},
+	"api_key_revoked": {
+		Spanish: "Clave de API revocada",
+		English: "API key revoked",
+	},
+	"email_retrying": {
+		Spanish: "El servidor SMTP no está disponible por ahora; el correo se reintentará más tarde",
+		English: "The SMTP server is temporarily unavailable; the email will be retried later",
+	},
+	"email_partially_sent": {
+		Spanish: "El servidor aceptó el correo para algunos destinatarios; a los demás se les reintentará más tarde",
+		English: "The server accepted the email for some recipients; the others will be retried later",
+	},
+	"template_deleted": {
+		Spanish: "Plantilla eliminada",
+		English: "Template deleted",
+	},
+
+	// Autenticación
+	"missing_authorization": {
+		Spanish: "Falta el encabezado Authorization",
+		English: "Missing Authorization header",
+	},
+	"invalid_authorization": {
+		Spanish: "Formato inválido del encabezado Authorization",
+		English: "Invalid Authorization header format",
+	},
+	"invalid_token": {
+		Spanish: "Token inválido",
+		English: "Invalid token",
+	},
+	"unknown_token": {
+		Spanish: "Token no registrado",
+		English: "Unknown token",
+	},
+	"forbidden": {
+		Spanish: "Acceso denegado",
+		English: "Forbidden",
+	},
+	"insufficient_scope": {
+		Spanish: "La clave de API no tiene el permiso %s",
+		English: "The API key lacks the %s scope",
+	},
+	"api_key_name_required": {
+		Spanish: "La clave de API necesita un nombre",
+		English: "The API key needs a name",
+	},
+	"invalid_scopes": {
+		Spanish: "Permisos inválidos; usa send, templates:read, templates:write, logs:read o admin",
+		English: "Invalid scopes; use send, templates:read, templates:write, logs:read or admin",
+	},
+	"api_key_not_found": {
+		Spanish: "La clave de API no existe",
+		English: "The API key does not exist",
+	},
+	"last_admin_key": {
+		Spanish: "No se puede revocar la última clave con permiso admin",
+		English: "The last key with the admin scope cannot be revoked",
+	},
+
+	// Solicitudes
+	"invalid_request": {
+		Spanish: "Datos inválidos",
+		English: "Invalid data",
+	},
+	"invalid_body": {
+		Spanish: "Error al leer el cuerpo de la solicitud",
+		English: "Could not read the request body",
+	},
+	"invalid_tls_policy": {
+		Spanish: "Política TLS inválida",
+		English: "Invalid TLS policy",
+	},
+
+	// Registro de credenciales
+	"password_required": {
+		Spanish: "Se requiere una contraseña o un refresh token",
+		English: "A password or a refresh token is required",
+	},
+	"oauth_provider_unsupported": {
+		Spanish: "Proveedor OAuth no soportado",
+		English: "Unsupported OAuth provider",
+	},
+	"invalid_smtp_server": {
+		Spanish: "Servidor SMTP inválido",
+		English: "Invalid SMTP server",
+	},
+	"invalid_credentials": {
+		Spanish: "Credenciales incorrectas",
+		English: "Invalid credentials",
+	},
+
+	// Credenciales guardadas
+	"encryption_failed": {
+		Spanish: "Error al cifrar la credencial",
+		English: "Could not encrypt the credential",
+	},
+	"decryption_failed": {
+		Spanish: "Error al desencriptar la credencial",
+		English: "Could not decrypt the credential",
+	},
+	"invalid_credential": {
+		Spanish: "Error procesando credenciales",
+		English: "The stored credential is corrupt",
+	},
+	"storage_error": {
+		Spanish: "Error al acceder al almacenamiento",
+		English: "Storage error",
+	},
+	"internal_error": {
+		Spanish: "Error interno",
+		English: "Internal error",
+	},
+
+	// DKIM
+	"invalid_dkim_key": {
+		Spanish: "Clave DKIM inválida",
+		English: "Invalid DKIM key",
+	},
+	"dkim_domain_mismatch": {
+		Spanish: "El dominio DKIM debe coincidir con el del remitente",
+		English: "The DKIM domain must match the sender's domain",
+	},
+
+	// Envío
+	"send_failed": {
+		Spanish: "No se pudo enviar el correo",
+		English: "The email could not be sent",
+	},
+	"tls_required": {
+		Spanish: "El servidor SMTP no permite una conexión cifrada",
+		English: "The SMTP server does not allow an encrypted connection",
+	},
+	"oauth_refresh_failed": {
+		Spanish: "No se pudo renovar el access token OAuth; vuelve a registrar la cuenta",
+		English: "Could not refresh the OAuth access token; register the account again",
+	},
+	"auth_mechanism_unsupported": {
+		Spanish: "El servidor SMTP no ofrece un mecanismo de autenticación compatible",
+		English: "The SMTP server does not offer a compatible authentication mechanism",
+	},
+	"invalid_address": {
+		Spanish: "Dirección de correo inválida",
+		English: "Invalid email address",
+	},
+	"invalid_header": {
+		Spanish: "Cabecera inválida",
+		English: "Invalid header",
+	},
+	"header_not_allowed": {
+		Spanish: "Cabecera no permitida",
+		English: "Header not allowed",
+	},
+	"no_recipients": {
+		Spanish: "El mensaje no tiene destinatarios",
+		English: "The message has no recipients",
+	},
+	"all_recipients_rejected": {
+		Spanish: "El servidor rechazó a todos los destinatarios",
+		English: "The server rejected every recipient",
+	},
+	"recipients_deferred": {
+		Spanish: "El servidor rechazó temporalmente a algunos destinatarios",
+		English: "The server temporarily rejected some recipients",
+	},
+	"invalid_attachment": {
+		Spanish: "Adjunto inválido",
+		English: "Invalid attachment",
+	},
+	"attachment_too_large": {
+		Spanish: "Los adjuntos superan el tamaño máximo",
+		English: "The attachments exceed the maximum size",
+	},
+
+	// Envío asíncrono
+	"async_unavailable": {
+		Spanish: "El envío asíncrono no está habilitado en este servidor",
+		English: "Asynchronous sending is not enabled on this server",
+	},
+	"message_not_found": {
+		Spanish: "El mensaje no existe o ya expiró",
+		English: "The message does not exist or has expired",
+	},
+
+	// Plantillas
+	"template_not_found": {
+		Spanish: "La plantilla no existe",
+		English: "Template not found",
+	},
+	"invalid_template": {
+		Spanish: "Plantilla inválida",
+		English: "Invalid template",
+	},
+	"missing_variable": {
+		Spanish: "Falta una variable de la plantilla",
+		English: "A template variable is missing",
+	},
+
+	// Envíos masivos
+	"invalid_csv": {
+		Spanish: "CSV inválido",
+		English: "Invalid CSV",
+	},
+	"no_rows": {
+		Spanish: "No hay filas para enviar",
+		English: "There are no rows to send",
+	},
+	"too_many_rows": {
+		Spanish: "Se permiten como máximo %d filas por solicitud",
+		English: "At most %d rows are allowed per request",
+	},
+	"body_required": {
+		Spanish: "Se requiere htmlBody, textBody o templateId",
+		English: "htmlBody, textBody or templateId is required",
+	},
+	"invalid_rows": {
+		Spanish: "Hay filas inválidas, no se envió ningún correo",
+		English: "Some rows are invalid, no email was sent",
+	},
+	"report_not_found": {
+		Spanish: "El reporte no existe o ya expiró",
+		English: "The report does not exist or has expired",
+	},
+
+	// Correo de bienvenida
+	"welcome_subject": {
+		Spanish: "¡Bienvenido a MailApi! 🎉",
+		English: "Welcome to MailApi! 🎉",
+	},
+	"welcome_body": {
+		Spanish: "<html><body><h1>¡Hola ! 👋</h1>" +
+			"<p>Este es un correo de prueba desde <strong>MailApi</strong> 📧</p>" +
+			"<p>Si recibes este mensaje, ¡felicitaciones! El correo es válido ✅.</p>" +
+			"<p>Por favor, guarda bien el token que se te ha generado, ya que lo necesitarás para realizar solicitudes autenticadas.<br> El token es: <strong>%s</strong> 🗝️</p>" +
+			"<p>Para más información sobre cómo utilizar <strong>MailApi</strong>, haz clic en el siguiente enlace:</p>" +
+			"<p><a href='https://www.mailapi.com/guia-de-uso' target='_blank'>Guía de Uso de MailApi 📚</a></p>" +
+			"</body></html>",
+		English: "<html><body><h1>Hello! 👋</h1>" +
+			"<p>This is a test email from <strong>MailApi</strong> 📧</p>" +
+			"<p>If you are reading this, congratulations! Your email account works ✅.</p>" +
+			"<p>Please keep the token we generated for you somewhere safe, you will need it to make authenticated requests.<br> Your token is: <strong>%s</strong> 🗝️</p>" +
+			"<p>To learn more about using <strong>MailApi</strong>, follow this link:</p>" +
+			"<p><a href='https://www.mailapi.com/guia-de-uso' target='_blank'>MailApi User Guide 📚</a></p>" +
+			"</body></html>",
+	},
+}
@@ -0,0 +1,99 @@
+package kms
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Keyring es un KMS local: las claves maestras (AES-256) se leen de un
+// archivo o de la configuración y se identifican por un id libre. Para rotar
+// se agrega una clave nueva, se la marca como activa y se conservan las
+// anteriores hasta volver a envolver todas las claves de datos.
+//
+// Formato:
+//
+//	{"active": "2026-10", "keys": {"2026-09": "<64 hex>", "2026-10": "<64 hex>"}}
+type Keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+type keyringFile struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// LoadKeyring lee las claves maestras de un archivo.
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("no se pudo leer %s: %w", path, err)
+	}
+	return ParseKeyring(data)
+}
+
+// ParseKeyring lee las claves maestras en el formato de LoadKeyring.
+func ParseKeyring(data []byte) (*Keyring, error) {
+	var file keyringFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("formato de claves maestras inválido: %w", err)
+	}
+
+	kr := &Keyring{active: file.Active, keys: map[string]cipher.AEAD{}}
+	for id, value := range file.Keys {
+		key, err := hex.DecodeString(value)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("la clave maestra %s debe tener 64 caracteres hexadecimales (32 bytes)", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if kr.keys[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := kr.keys[kr.active]; !ok {
+		return nil, fmt.Errorf("la clave maestra activa %q no está entre las claves", kr.active)
+	}
+	return kr, nil
+}
+
+func (kr *Keyring) KeyID() string {
+	return kr.active
+}
+
+// Wrap cifra la clave de datos con AES-GCM y la clave activa. El resultado es
+// nonce | clave cifrada + etiqueta; el id va como dato autenticado.
+func (kr *Keyring) Wrap(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	gcm := kr.keys[kr.active]
+
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(dataKey)+gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return kr.active, gcm.Seal(nonce, nonce, dataKey, []byte(kr.active)), nil
+}
+
+func (kr *Keyring) Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	gcm, ok := kr.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+	if len(wrapped) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, ErrInvalidKey
+	}
+
+	dataKey, err := gcm.Open(nil, wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():], []byte(keyID))
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	return dataKey, nil
+}
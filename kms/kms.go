@@ -0,0 +1,55 @@
+// Package kms protege las claves de datos de los registros con una clave
+// maestra que guarda el servidor (envelope encryption). Cada registro se
+// cifra con su propia clave de datos y solo esa clave, envuelta, se guarda
+// junto al registro; rotar la clave maestra consiste en volver a envolverlas.
+package kms
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+)
+
+// DataKeySize es el tamaño de las claves de datos (AES-256).
+const DataKeySize = 32
+
+var (
+	ErrUnknownKey = errors.New("kms: clave maestra desconocida")
+	ErrInvalidKey = errors.New("kms: la clave de datos es inválida o fue alterada")
+)
+
+// KMS envuelve y desenvuelve claves de datos. Keyring es la implementación
+// local; un KMS externo (AWS, GCP, Vault...) puede cumplir la misma interfaz.
+type KMS interface {
+	// KeyID es la clave maestra activa, con la que se envuelven las claves nuevas.
+	KeyID() string
+	Wrap(ctx context.Context, dataKey []byte) (keyID string, wrapped []byte, err error)
+	Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// NewDataKey genera una clave de datos aleatoria.
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, DataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Rewrap vuelve a envolver una clave de datos con la clave maestra activa.
+// Si ya lo estaba devuelve changed en false y no la toca.
+func Rewrap(ctx context.Context, k KMS, keyID string, wrapped []byte) (newKeyID string, rewrapped []byte, changed bool, err error) {
+	if keyID == k.KeyID() {
+		return keyID, wrapped, false, nil
+	}
+
+	dataKey, err := k.Unwrap(ctx, keyID, wrapped)
+	if err != nil {
+		return "", nil, false, err
+	}
+	newKeyID, rewrapped, err = k.Wrap(ctx, dataKey)
+	if err != nil {
+		return "", nil, false, err
+	}
+	return newKeyID, rewrapped, true, nil
+}
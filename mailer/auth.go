@@ -0,0 +1,135 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+)
+
+// Mechanism es un mecanismo SASL de autenticación SMTP.
+type Mechanism string
+
+const (
+	MechXOAuth2 Mechanism = "XOAUTH2"
+	MechCRAMMD5 Mechanism = "CRAM-MD5"
+	MechPlain   Mechanism = "PLAIN"
+	MechLogin   Mechanism = "LOGIN"
+)
+
+// Mecanismos con contraseña, del más fuerte al más débil
+var passwordMechanisms = []Mechanism{MechCRAMMD5, MechPlain, MechLogin}
+
+// Validate comprueba que el mecanismo sea conocido (vacío se acepta).
+func (m Mechanism) Validate() error {
+	switch m {
+	case "", MechXOAuth2, MechCRAMMD5, MechPlain, MechLogin:
+		return nil
+	}
+	return fmt.Errorf("mecanismo de autenticación desconocido: %q", m)
+}
+
+// Login son los datos con los que una cuenta se autentica ante el servidor SMTP.
+type Login struct {
+	Username    string
+	Password    string
+	AccessToken string // token OAuth2; si está presente se usa XOAUTH2
+}
+
+// Mecanismos que la cuenta puede usar según sus datos
+func (l Login) mechanisms() []Mechanism {
+	if l.AccessToken != "" {
+		return []Mechanism{MechXOAuth2}
+	}
+	if l.Password != "" {
+		return passwordMechanisms
+	}
+	return nil
+}
+
+func (l Login) auth(m Mechanism, host string) smtp.Auth {
+	switch m {
+	case MechXOAuth2:
+		return XOAuth2Auth(l.Username, l.AccessToken, host)
+	case MechCRAMMD5:
+		return smtp.CRAMMD5Auth(l.Username, l.Password)
+	case MechLogin:
+		return LoginAuth(l.Username, l.Password, host)
+	default:
+		return smtp.PlainAuth("", l.Username, l.Password, host)
+	}
+}
+
+type xoauth2Auth struct {
+	username, token, host string
+}
+
+// XOAuth2Auth implementa el mecanismo SASL XOAUTH2 usado por Gmail y Microsoft 365.
+// Igual que smtp.PlainAuth, solo envía el token sobre conexiones cifradas o a localhost.
+func XOAuth2Auth(username, token, host string) smtp.Auth {
+	return &xoauth2Auth{username, token, host}
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("conexión sin cifrar")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("nombre de host incorrecto")
+	}
+
+	resp := []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01")
+	return "XOAUTH2", resp, nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	// Si el token es rechazado el servidor envía un JSON con el detalle y
+	// espera una respuesta vacía antes de devolver el error definitivo.
+	if more {
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+type loginAuth struct {
+	username, password, host string
+	step                     int
+}
+
+// LoginAuth implementa el mecanismo AUTH LOGIN que aún usan algunos relays
+// Exchange y de hosting. Solo envía la contraseña sobre conexiones cifradas
+// o a localhost.
+func LoginAuth(username, password, host string) smtp.Auth {
+	return &loginAuth{username: username, password: password, host: host}
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("conexión sin cifrar")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("nombre de host incorrecto")
+	}
+
+	a.step = 0
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	// El servidor pide primero el usuario ("Username:") y luego la contraseña
+	a.step++
+	switch a.step {
+	case 1:
+		return []byte(a.username), nil
+	case 2:
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("desafío AUTH LOGIN inesperado: %q", fromServer)
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
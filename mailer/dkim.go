@@ -0,0 +1,317 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Cabeceras que se firman si están presentes en el mensaje
+var dkimHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// DKIMSigner firma mensajes con DKIM (RFC 6376) usando canonicalización
+// relaxed/relaxed. La clave puede ser RSA o Ed25519 (RFC 8463).
+type DKIMSigner struct {
+	Domain   string
+	Selector string
+	Key      crypto.Signer
+}
+
+// ParseDKIMKey lee una clave privada PEM (PKCS#1 o PKCS#8) RSA o Ed25519.
+func ParseDKIMKey(pemData []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("la clave DKIM no está en formato PEM")
+	}
+
+	var key any
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("clave DKIM inválida: %v", err)
+		}
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < 1024 {
+			return nil, errors.New("las claves RSA para DKIM deben tener al menos 1024 bits")
+		}
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("tipo de clave DKIM no soportado: %T", key)
+}
+
+func (s *DKIMSigner) algorithm() string {
+	if _, ok := s.Key.(ed25519.PrivateKey); ok {
+		return "ed25519-sha256"
+	}
+	return "rsa-sha256"
+}
+
+// DNSRecord devuelve el registro TXT a publicar en <selector>._domainkey.<dominio>.
+func (s *DKIMSigner) DNSRecord() (string, error) {
+	keyType := "rsa"
+	var pub []byte
+
+	switch key := s.Key.Public().(type) {
+	case ed25519.PublicKey:
+		keyType = "ed25519"
+		pub = key
+	default:
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			return "", err
+		}
+		pub = der
+	}
+
+	return "v=DKIM1; k=" + keyType + "; p=" + base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// Sign devuelve el mensaje con la cabecera DKIM-Signature añadida al inicio.
+func (s *DKIMSigner) Sign(message []byte) ([]byte, error) {
+	headers, body := splitMessage(message)
+
+	var signed []string
+	for _, name := range dkimHeaders {
+		if _, ok := findHeader(headers, name); ok {
+			signed = append(signed, strings.ToLower(name))
+		}
+	}
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	value := "v=1; a=" + s.algorithm() + "; c=relaxed/relaxed; d=" + s.Domain + "; s=" + s.Selector +
+		"; t=" + strconv.FormatInt(time.Now().Unix(), 10) + "; h=" + strings.Join(signed, ":") +
+		"; bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) + "; b="
+
+	hash := dkimHeaderHash(headers, signed, "DKIM-Signature: "+value)
+
+	var (
+		sig []byte
+		err error
+	)
+	if _, ok := s.Key.(ed25519.PrivateKey); ok {
+		sig, err = s.Key.Sign(rand.Reader, hash, crypto.Hash(0))
+	} else {
+		sig, err = s.Key.Sign(rand.Reader, hash, crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error al firmar con DKIM: %v", err)
+	}
+
+	// Se parte la firma con espacios (ignorados por los verificadores) para
+	// poder plegar la cabecera
+	encoded := base64.StdEncoding.EncodeToString(sig)
+	var chunks []string
+	for len(encoded) > 64 {
+		chunks = append(chunks, encoded[:64])
+		encoded = encoded[64:]
+	}
+	chunks = append(chunks, encoded)
+
+	header := foldHeader("DKIM-Signature", value+strings.Join(chunks, " "))
+	return append([]byte(header+"\r\n"), message...), nil
+}
+
+var (
+	foldingSpace  = regexp.MustCompile(`\s+`)
+	signatureData = regexp.MustCompile(`(;\s*b=)[^;]*$`)
+	dnsName       = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+)
+
+// VerifyDKIM comprueba la primera firma DKIM del mensaje con la clave pública
+// indicada (sin consultar DNS). Sirve para validar una clave recién subida.
+func VerifyDKIM(message []byte, pub crypto.PublicKey) error {
+	headers, body := splitMessage(message)
+
+	raw, ok := findHeader(headers, "DKIM-Signature")
+	if !ok {
+		return errors.New("el mensaje no tiene firma DKIM")
+	}
+
+	tags := map[string]string{}
+	_, value, _ := strings.Cut(raw, ":")
+	for _, tag := range strings.Split(value, ";") {
+		k, v, _ := strings.Cut(tag, "=")
+		tags[strings.TrimSpace(k)] = foldingSpace.ReplaceAllString(v, "")
+	}
+
+	if tags["c"] != "relaxed/relaxed" {
+		return fmt.Errorf("canonicalización no soportada: %q", tags["c"])
+	}
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return errors.New("el hash del cuerpo no coincide")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fmt.Errorf("firma DKIM mal codificada: %v", err)
+	}
+
+	// La firma cubre la propia cabecera DKIM-Signature con b= vacío
+	unsigned := signatureData.ReplaceAllString(raw, "$1")
+	hash := dkimHeaderHash(headers, strings.Split(tags["h"], ":"), unsigned)
+
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash, sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, hash, sig) {
+			err = errors.New("ed25519: firma inválida")
+		}
+	default:
+		err = fmt.Errorf("tipo de clave no soportado: %T", pub)
+	}
+	if err != nil {
+		return fmt.Errorf("la firma DKIM no es válida: %v", err)
+	}
+	return nil
+}
+
+// Hash SHA-256 de las cabeceras firmadas y de la cabecera DKIM-Signature
+// (esta última sin el CRLF final)
+func dkimHeaderHash(headers []string, signed []string, dkimHeader string) []byte {
+	h := sha256.New()
+	used := map[string]int{}
+
+	for _, name := range signed {
+		// Si una cabecera se repite se firman de abajo hacia arriba
+		raw, ok := findHeaderFromEnd(headers, name, used[strings.ToLower(name)])
+		used[strings.ToLower(name)]++
+		if ok {
+			h.Write([]byte(relaxedHeader(raw) + "\r\n"))
+		}
+	}
+
+	h.Write([]byte(relaxedHeader(dkimHeader)))
+	return h.Sum(nil)
+}
+
+// Separa las cabeceras (cada una con sus líneas plegadas) del cuerpo
+func splitMessage(message []byte) ([]string, []byte) {
+	head, body, found := bytes.Cut(message, []byte("\r\n\r\n"))
+	if !found {
+		return nil, message
+	}
+
+	var headers []string
+	for _, line := range strings.Split(string(head), "\r\n") {
+		if len(headers) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			headers[len(headers)-1] += "\r\n" + line
+			continue
+		}
+		headers = append(headers, line)
+	}
+	return headers, body
+}
+
+func findHeader(headers []string, name string) (string, bool) {
+	for _, h := range headers {
+		if k, _, ok := strings.Cut(h, ":"); ok && strings.EqualFold(strings.TrimSpace(k), name) {
+			return h, true
+		}
+	}
+	return "", false
+}
+
+func findHeaderFromEnd(headers []string, name string, skip int) (string, bool) {
+	for i := len(headers) - 1; i >= 0; i-- {
+		if k, _, ok := strings.Cut(headers[i], ":"); ok && strings.EqualFold(strings.TrimSpace(k), name) {
+			if skip == 0 {
+				return headers[i], true
+			}
+			skip--
+		}
+	}
+	return "", false
+}
+
+var wsp = regexp.MustCompile(`[ \t]+`)
+
+// Canonicalización relaxed de una cabecera (RFC 6376, 3.4.2)
+func relaxedHeader(raw string) string {
+	name, value, _ := strings.Cut(raw, ":")
+	value = strings.NewReplacer("\r\n", "").Replace(value)
+	value = wsp.ReplaceAllString(value, " ")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(value)
+}
+
+// Canonicalización relaxed del cuerpo (RFC 6376, 3.4.4)
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(wsp.ReplaceAllString(line, " "), " ")
+	}
+
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// DomainAligned indica si domain puede firmar el correo de sender: debe ser
+// el dominio del remitente o uno superior sin pasar del dominio organizacional
+// (acme.com, acme.co.uk), de modo que la firma quede alineada para DMARC y
+// nunca se acepte un sufijo público como "com".
+func DomainAligned(domain, sender string) bool {
+	domain, sender = strings.ToLower(domain), strings.ToLower(sender)
+	if domain != sender && !strings.HasSuffix(sender, "."+domain) {
+		return false
+	}
+
+	org, err := publicsuffix.EffectiveTLDPlusOne(sender)
+	if err != nil {
+		return false
+	}
+	return domain == org || strings.HasSuffix(domain, "."+org)
+}
+
+// Check firma un mensaje de prueba y verifica la firma con la clave pública,
+// para rechazar claves que no funcionen antes de guardarlas.
+func (s *DKIMSigner) Check() error {
+	if !dnsName.MatchString(s.Domain) {
+		return fmt.Errorf("dominio DKIM inválido: %q", s.Domain)
+	}
+	if !dnsName.MatchString(s.Selector) {
+		return fmt.Errorf("selector DKIM inválido: %q", s.Selector)
+	}
+
+	probe := &Message{
+		From:     "dkim@" + s.Domain,
+		To:       []string{"dkim@" + s.Domain},
+		Subject:  "DKIM",
+		TextBody: "DKIM",
+		DKIM:     s,
+	}
+
+	data, err := probe.Bytes()
+	if err != nil {
+		return err
+	}
+	return VerifyDKIM(data, s.Key.Public())
+}
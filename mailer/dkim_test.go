@@ -0,0 +1,217 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testDKIMKeys(t *testing.T) map[string]crypto.Signer {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]crypto.Signer{"rsa-sha256": rsaKey, "ed25519-sha256": edKey}
+}
+
+// Mensaje multipart con HTML, imagen inline y adjunto
+func testDKIMMessage(signer *DKIMSigner, subject string) *Message {
+	return &Message{
+		From:     "billing@acme.com",
+		FromName: "Acme Facturación",
+		To:       []string{"Ana <ana@example.com>"},
+		Cc:       []string{"luis@example.com"},
+		Subject:  subject,
+		HtmlBody: `<p>Hola Ana,</p><p>adjuntamos tu factura.</p><img src="cid:logo">`,
+		Attachments: []Attachment{
+			{Filename: "factura.pdf", ContentType: "application/pdf", Content: []byte("%PDF-1.4 factura")},
+			{Filename: "logo.png", ContentType: "image/png", Content: []byte("\x89PNG logo"), ContentID: "logo"},
+		},
+		DKIM: signer,
+	}
+}
+
+// Reemplaza old por new solo en las cabeceras o solo en el cuerpo
+func replaceIn(part string, data []byte, old, new string) []byte {
+	head, body, _ := bytes.Cut(data, []byte("\r\n\r\n"))
+	if part == "head" {
+		head = bytes.Replace(head, []byte(old), []byte(new), 1)
+	} else {
+		body = bytes.Replace(body, []byte(old), []byte(new), 1)
+	}
+	return append(append(head, "\r\n\r\n"...), body...)
+}
+
+func TestDKIMRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(data []byte) []byte
+		valid  bool
+	}{
+		{name: "sin cambios", tamper: func(data []byte) []byte { return data }, valid: true},
+		{
+			// relaxed/relaxed tolera cambios de espacios y de mayúsculas en los nombres
+			name:   "espacios y mayúsculas",
+			tamper: func(data []byte) []byte { return replaceIn("head", data, "Cc: ", "CC:  \t") },
+			valid:  true,
+		},
+		{
+			name: "cabecera no firmada añadida",
+			tamper: func(data []byte) []byte {
+				return append([]byte("Received: from relay.example.com\r\n"), data...)
+			},
+			valid: true,
+		},
+		{name: "cuerpo alterado", tamper: func(data []byte) []byte { return replaceIn("body", data, "factura.", "factura!") }},
+		{name: "adjunto alterado", tamper: func(data []byte) []byte { return replaceIn("body", data, "JVBERi0xLjQg", "JVBERi0xLjUg") }},
+		{name: "destinatario alterado", tamper: func(data []byte) []byte { return replaceIn("head", data, "ana@example.com", "eve@example.com") }},
+		{name: "asunto alterado", tamper: func(data []byte) []byte { return replaceIn("head", data, "Factura", "Fxctura") }},
+		{
+			// Los verificadores usan la última aparición de cada cabecera firmada
+			name: "cabecera firmada añadida al final",
+			tamper: func(data []byte) []byte {
+				start := bytes.Index(data, []byte("\r\nCc: ")) + 2
+				end := start + bytes.Index(data[start:], []byte("\r\n"))
+				return slices.Concat(data[:end], []byte("\r\nCc: eve@example.com"), data[end:])
+			},
+		},
+	}
+
+	for alg, key := range testDKIMKeys(t) {
+		signer := &DKIMSigner{Domain: "acme.com", Selector: "mailapi", Key: key}
+
+		for _, subject := range []string{
+			"Factura de octubre",
+			"Factura de octubre: ¡tu resumen mensual de facturación y consumo ya está disponible! 🎉",
+		} {
+			data, err := testDKIMMessage(signer, subject).Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(data), "a="+alg) {
+				t.Fatalf("%s: la firma no usa el algoritmo esperado", alg)
+			}
+
+			for _, tt := range tests {
+				t.Run(alg+"/"+tt.name, func(t *testing.T) {
+					tampered := tt.tamper(bytes.Clone(data))
+					if !tt.valid && bytes.Equal(tampered, data) {
+						t.Fatal("la alteración no cambió el mensaje")
+					}
+					err := VerifyDKIM(tampered, key.Public())
+					if tt.valid && err != nil {
+						t.Errorf("la firma no se verificó: %v", err)
+					}
+					if !tt.valid && err == nil {
+						t.Error("se aceptó un mensaje alterado")
+					}
+				})
+			}
+		}
+
+		t.Run(alg+"/otra clave", func(t *testing.T) {
+			data, err := testDKIMMessage(signer, "Factura").Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			other := testDKIMKeys(t)[alg]
+			if VerifyDKIM(data, other.Public()) == nil {
+				t.Error("la firma se verificó con otra clave")
+			}
+		})
+	}
+}
+
+func TestParseDKIMKey(t *testing.T) {
+	keys := testDKIMKeys(t)
+	rsaKey := keys["rsa-sha256"].(*rsa.PrivateKey)
+	pkcs8 := func(key any) []byte {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		pem     []byte
+		keyType string // vacío si debe rechazarse
+	}{
+		{name: "RSA PKCS#1", pem: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), keyType: "rsa"},
+		{name: "RSA PKCS#8", pem: pkcs8(rsaKey), keyType: "rsa"},
+		{name: "Ed25519 PKCS#8", pem: pkcs8(keys["ed25519-sha256"]), keyType: "ed25519"},
+		{name: "ECDSA", pem: pkcs8(ecKey)},
+		{name: "sin PEM", pem: []byte("clave")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ParseDKIMKey(tt.pem)
+			if tt.keyType == "" {
+				if err == nil {
+					t.Fatal("se aceptó la clave")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signer := &DKIMSigner{Domain: "acme.com", Selector: "mailapi", Key: key}
+			if err := signer.Check(); err != nil {
+				t.Fatalf("Check: %v", err)
+			}
+			record, err := signer.DNSRecord()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(record, "v=DKIM1; k="+tt.keyType+"; p=") {
+				t.Errorf("registro DNS = %q", record)
+			}
+		})
+	}
+}
+
+func TestDomainAligned(t *testing.T) {
+	tests := []struct {
+		domain, sender string
+		want           bool
+	}{
+		{"acme.com", "acme.com", true},
+		{"ACME.com", "acme.COM", true},
+		{"acme.com", "ventas.acme.com", true},
+		{"ventas.acme.com", "eu.ventas.acme.com", true},
+		{"acme.co.uk", "mail.acme.co.uk", true},
+		{"com", "acme.com", false},
+		{"co.uk", "acme.co.uk", false},
+		{"uk", "acme.co.uk", false},
+		{"ventas.acme.com", "acme.com", false},
+		{"otra.com", "acme.com", false},
+		{"me.com", "acme.com", false},
+		{"localhost", "localhost", false},
+	}
+	for _, tt := range tests {
+		if got := DomainAligned(tt.domain, tt.sender); got != tt.want {
+			t.Errorf("DomainAligned(%q, %q) = %v, se esperaba %v", tt.domain, tt.sender, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"syscall"
+)
+
+// Códigos de error estables que la API expone a los clientes
+const (
+	CodeTLSRequired     = "tls_required"
+	CodeOAuthRefresh    = "oauth_refresh_failed"
+	CodeAuthUnsupported = "auth_mechanism_unsupported"
+
+	CodeInvalidAddress     = "invalid_address"
+	CodeInvalidHeader      = "invalid_header"
+	CodeHeaderNotAllowed   = "header_not_allowed"
+	CodeNoRecipients       = "no_recipients"
+	CodeRecipientsRejected = "all_recipients_rejected"
+	CodeRecipientsDeferred = "recipients_deferred"
+	CodeInvalidAttachment  = "invalid_attachment"
+	CodeAttachmentTooLarge = "attachment_too_large"
+
+	CodeTemplateNotFound = "template_not_found"
+	CodeInvalidTemplate  = "invalid_template"
+	CodeMissingVariable  = "missing_variable"
+	CodeInvalidCSV       = "invalid_csv"
+)
+
+// Error es un error de envío con un código legible por máquinas.
+type Error struct {
+	Code    string
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Temporary indica si un error de envío es transitorio y conviene
+// reintentarlo: respuestas SMTP 4xx, conexiones rechazadas o cortadas y
+// tiempos de espera agotados. Las respuestas 5xx, los certificados inválidos
+// y los errores de validación son definitivos.
+func Temporary(err error) bool {
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code >= 400 && smtpErr.Code < 500
+	}
+
+	var certErr *tls.CertificateVerificationError
+	if errors.As(err, &certErr) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE)
+}
@@ -0,0 +1,173 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// headerBuilder escribe las cabeceras del mensaje. Los valores nunca se
+// concatenan sin revisar: un CR o LF permitiría inyectar cabeceras nuevas
+// (por ejemplo un asunto con "\r\nBcc: victima@x").
+type headerBuilder struct {
+	buf bytes.Buffer
+	err error
+}
+
+func (h *headerBuilder) set(name, value string) {
+	if h.err != nil {
+		return
+	}
+	if err := checkHeaderValue(name, value); err != nil {
+		h.err = err
+		return
+	}
+	h.buf.WriteString(foldHeader(name, value) + "\r\n")
+}
+
+// Escribe una cabecera de texto libre; si no es ASCII se codifica con
+// encoded-words de RFC 2047 (=?utf-8?q?...?=)
+func (h *headerBuilder) text(name, value string) {
+	if h.err == nil {
+		h.err = checkHeaderValue(name, value)
+	}
+	h.set(name, mime.QEncoding.Encode("utf-8", value))
+}
+
+// Escribe una cabecera de direcciones; si la lista está vacía se omite.
+// Los nombres visibles no ASCII los codifica net/mail con RFC 2047.
+func (h *headerBuilder) addresses(name string, list []string) {
+	if h.err != nil || len(list) == 0 {
+		return
+	}
+
+	addrs, err := parseAddresses(name, list)
+	if err != nil {
+		h.err = err
+		return
+	}
+	h.addressList(name, addrs)
+}
+
+func (h *headerBuilder) addressList(name string, addrs []*mail.Address) {
+	formatted := make([]string, len(addrs))
+	for i, addr := range addrs {
+		formatted[i] = addr.String()
+	}
+	h.set(name, strings.Join(formatted, ", "))
+}
+
+// Longitud de línea recomendada por RFC 5322, y la máxima que admite RFC 2047
+// en las líneas con encoded-words
+const (
+	maxLineLength        = 78
+	maxEncodedLineLength = 76
+)
+
+// Pliega la cabecera en líneas de hasta 78 caracteres (76 si lleva
+// encoded-words) cortando antes de un espacio, incluido el que sigue a
+// "Nombre:"; las palabras más largas que la línea se dejan enteras.
+func foldHeader(name, value string) string {
+	limit := maxLineLength
+	if strings.Contains(value, "=?") {
+		limit = maxEncodedLineLength
+	}
+
+	line := name + ": " + value
+	minCut := len(name) + 1
+
+	var out strings.Builder
+	for len(line) > limit {
+		cut := strings.LastIndexByte(line[:limit+1], ' ')
+		if cut < minCut {
+			next := strings.IndexByte(line[limit:], ' ')
+			if next < 0 {
+				break
+			}
+			cut = limit + next
+		}
+
+		out.WriteString(line[:cut] + "\r\n")
+		line = line[cut:]
+		minCut = 1
+	}
+
+	out.WriteString(line)
+	return out.String()
+}
+
+func checkHeaderValue(name, value string) error {
+	if strings.ContainsAny(value, "\r\n") {
+		return &Error{Code: CodeInvalidHeader, Message: fmt.Sprintf("la cabecera %s no puede contener saltos de línea", name)}
+	}
+	return nil
+}
+
+// Valida cada dirección con net/mail ("ana@x.com" o "Ana <ana@x.com>")
+func parseAddresses(name string, list []string) ([]*mail.Address, error) {
+	addrs := make([]*mail.Address, 0, len(list))
+	for _, raw := range list {
+		addr, err := mail.ParseAddress(raw)
+		if err != nil {
+			return nil, &Error{Code: CodeInvalidAddress, Message: fmt.Sprintf("dirección inválida en %s: %q", name, raw), Err: err}
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// Dirección sin nombre visible para el sobre SMTP
+func envelopeAddress(raw string) string {
+	if addr, err := mail.ParseAddress(raw); err == nil {
+		return addr.Address
+	}
+	return raw
+}
+
+// Cabeceras que solo escribe el propio builder (o el firmado DKIM); un
+// cliente nunca puede sobrescribirlas con Headers.
+var protectedHeaders = map[string]bool{
+	"From": true, "Sender": true, "To": true, "Cc": true, "Bcc": true,
+	"Subject": true, "Date": true, "Message-Id": true, "Mime-Version": true,
+	"Reply-To": true, "In-Reply-To": true, "References": true,
+	"Content-Type": true, "Content-Transfer-Encoding": true, "Content-Disposition": true,
+	"Return-Path": true, "Received": true, "Dkim-Signature": true,
+}
+
+// Cabeceras estándar permitidas además de las X-*
+var allowedHeaders = map[string]bool{
+	"List-Unsubscribe": true, "List-Unsubscribe-Post": true, "List-Id": true,
+	"Precedence": true, "Auto-Submitted": true, "Importance": true, "Priority": true,
+}
+
+// CheckCustomHeader comprueba que un cliente pueda fijar la cabecera name:
+// tiene que ser X-* o estar en la lista permitida, nunca una protegida.
+func CheckCustomHeader(name, value string) error {
+	if name == "" || strings.IndexFunc(name, func(r rune) bool { return r <= ' ' || r > '~' || r == ':' }) >= 0 {
+		return &Error{Code: CodeInvalidHeader, Message: fmt.Sprintf("nombre de cabecera inválido: %q", name)}
+	}
+
+	canonical := textproto.CanonicalMIMEHeaderKey(name)
+	if protectedHeaders[canonical] || !(strings.HasPrefix(canonical, "X-") || allowedHeaders[canonical]) {
+		return &Error{Code: CodeHeaderNotAllowed, Message: fmt.Sprintf("la cabecera %s no se puede fijar", name)}
+	}
+
+	return checkHeaderValue(name, value)
+}
+
+// Normaliza un identificador de mensaje a la forma <id@dominio>
+func formatMessageID(name, id string) (string, error) {
+	id = strings.TrimSpace(id)
+	if !strings.HasPrefix(id, "<") {
+		id = "<" + id + ">"
+	}
+
+	inner := strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")
+	if !strings.HasSuffix(id, ">") || inner == "" || strings.ContainsAny(inner, "<> \t\r\n") {
+		return "", &Error{Code: CodeInvalidHeader, Message: fmt.Sprintf("identificador de mensaje inválido en %s: %q", name, id)}
+	}
+	return id, nil
+}
@@ -0,0 +1,99 @@
+package mailer
+
+import (
+	"bytes"
+	"mime"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestFoldHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		message *Message
+		header  string
+		want    string // valor decodificado
+	}{
+		{
+			name:    "asunto codificado largo",
+			message: &Message{Subject: "¡Bienvenido a MailApi! 🎉 Tu cuenta de facturación ya está activa y lista para enviar"},
+			header:  "Subject",
+			want:    "¡Bienvenido a MailApi! 🎉 Tu cuenta de facturación ya está activa y lista para enviar",
+		},
+		{
+			name:    "asunto codificado corto",
+			message: &Message{Subject: "Facturación"},
+			header:  "Subject",
+			want:    "Facturación",
+		},
+		{
+			name:    "asunto ASCII largo",
+			message: &Message{Subject: strings.Repeat("palabra ", 20)},
+			header:  "Subject",
+			want:    strings.TrimSpace(strings.Repeat("palabra ", 20)),
+		},
+		{
+			name:    "nombre visible codificado",
+			message: &Message{FromName: "Departamento de Facturación y Cobranzas Ñandú"},
+			header:  "From",
+			want:    "Departamento de Facturación y Cobranzas Ñandú <billing@acme.com>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := tt.message
+			msg.From = "billing@acme.com"
+			msg.To = []string{"ana@example.com"}
+			msg.TextBody = "Hola"
+
+			data, err := msg.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			head, _, _ := bytes.Cut(data, []byte("\r\n\r\n"))
+			for _, line := range strings.Split(string(head), "\r\n") {
+				limit := maxLineLength
+				if strings.Contains(line, "=?") {
+					limit = maxEncodedLineLength
+				}
+				if len(line) > limit {
+					t.Errorf("línea de %d caracteres (máximo %d): %q", len(line), limit, line)
+				}
+			}
+
+			parsed, err := mail.ReadMessage(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if tt.header == "From" {
+				addr, err := mail.ParseAddress(parsed.Header.Get("From"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = addr.Name + " <" + addr.Address + ">"
+			} else {
+				got, err = new(mime.WordDecoder).DecodeHeader(parsed.Header.Get(tt.header))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got != tt.want {
+				t.Errorf("%s = %q, se esperaba %q", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFoldHeaderLongWord(t *testing.T) {
+	// Una palabra más larga que la línea no se corta
+	value := "<https://acme.com/baja?id=" + strings.Repeat("x", 80) + ">"
+	got := foldHeader("List-Unsubscribe", value)
+
+	lines := strings.Split(got, "\r\n")
+	if len(lines) != 2 || lines[0] != "List-Unsubscribe:" || lines[1] != " "+value {
+		t.Errorf("foldHeader = %q", got)
+	}
+}
@@ -0,0 +1,115 @@
+package mailer
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Etiquetas cuyo contenido no se muestra como texto
+var skippedTags = map[string]bool{
+	"head": true, "script": true, "style": true, "title": true, "noscript": true,
+}
+
+// Etiquetas de bloque que separan líneas
+var blockTags = map[string]bool{
+	"p": true, "div": true, "br": true, "tr": true, "table": true, "ul": true, "ol": true,
+	"section": true, "article": true, "header": true, "footer": true, "blockquote": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "hr": true, "pre": true,
+}
+
+var (
+	spaces     = regexp.MustCompile(`[ \t\r\n\f]+`)
+	blankLines = regexp.MustCompile(`\n{3,}`)
+)
+
+type link struct {
+	href  string
+	start int
+}
+
+// HTMLToText obtiene una versión legible en texto plano de un cuerpo HTML,
+// para la parte text/plain de los mensajes que solo traen HTML.
+func HTMLToText(body string) string {
+	var (
+		out     strings.Builder
+		skip    int
+		links   []link
+		tokens  = html.NewTokenizer(strings.NewReader(body))
+		newline = func(n int) {
+			text := out.String()
+			for i := len(text) - len(strings.TrimRight(text, "\n")); i < n; i++ {
+				out.WriteByte('\n')
+			}
+		}
+	)
+
+	for {
+		tt := tokens.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+
+		tag, hasAttr := tokens.TagName()
+		name := string(tag)
+
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if skippedTags[name] && tt == html.StartTagToken {
+				skip++
+			}
+			switch {
+			case name == "li":
+				newline(1)
+				out.WriteString("- ")
+			case name == "a":
+				href := ""
+				for hasAttr {
+					var key, val []byte
+					key, val, hasAttr = tokens.TagAttr()
+					if string(key) == "href" {
+						href = string(val)
+					}
+				}
+				links = append(links, link{href: href, start: out.Len()})
+			case blockTags[name]:
+				newline(1)
+			}
+		case html.EndTagToken:
+			if skippedTags[name] && skip > 0 {
+				skip--
+			}
+			switch {
+			case name == "a" && len(links) > 0:
+				l := links[len(links)-1]
+				links = links[:len(links)-1]
+				// Se añade la URL salvo que el texto del enlace ya sea la URL
+				text := strings.TrimSpace(out.String()[l.start:])
+				if l.href != "" && !strings.HasPrefix(l.href, "#") && text != l.href {
+					out.WriteString(" (" + l.href + ")")
+				}
+			case name == "p" || name == "ul" || name == "ol" || strings.HasPrefix(name, "h") && len(name) == 2:
+				newline(2)
+			case blockTags[name] || name == "li":
+				newline(1)
+			}
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+			text := spaces.ReplaceAllString(string(tokens.Text()), " ")
+			if strings.HasSuffix(out.String(), "\n") || out.Len() == 0 {
+				text = strings.TrimLeft(text, " ")
+			}
+			out.WriteString(text)
+		}
+	}
+
+	lines := strings.Split(out.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	text := blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return strings.TrimSpace(text) + "\n"
+}
@@ -0,0 +1,63 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ReadCSV lee un CSV con fila de cabecera y devuelve cada fila como un mapa
+// columna -> valor, listo para usarse como variables de una plantilla.
+func ReadCSV(r io.Reader) ([]map[string]any, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// Excel agrega un BOM al exportar en UTF-8
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, &Error{Code: CodeInvalidCSV, Message: "el CSV está vacío"}
+	}
+	if err != nil {
+		return nil, &Error{Code: CodeInvalidCSV, Message: "no se pudo leer el CSV", Err: err}
+	}
+
+	seen := map[string]bool{}
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, &Error{Code: CodeInvalidCSV, Message: fmt.Sprintf("la columna %d no tiene nombre", i+1)}
+		}
+		if seen[name] {
+			return nil, &Error{Code: CodeInvalidCSV, Message: "columna repetida: " + name}
+		}
+		seen[name] = true
+		header[i] = name
+	}
+
+	var rows []map[string]any
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, &Error{Code: CodeInvalidCSV, Message: "no se pudo leer el CSV", Err: err}
+		}
+
+		row := make(map[string]any, len(header))
+		for i, name := range header {
+			row[name] = record[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
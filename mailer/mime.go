@@ -0,0 +1,290 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Bytes arma el mensaje en formato RFC 5322 listo para DATA.
+//
+// Estructura generada:
+//
+//	multipart/mixed                (solo si hay adjuntos)
+//	├── multipart/alternative      (solo si hay HTML)
+//	│   ├── text/plain
+//	│   └── multipart/related      (solo si hay imágenes inline)
+//	│       ├── text/html
+//	│       └── imágenes inline (cid:...)
+//	└── adjuntos...
+//
+// Si el mensaje no tiene Date o MessageID se completan aquí, de modo que los
+// reintentos del mismo mensaje conservan su identificador.
+func (m *Message) Bytes() ([]byte, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+
+	if m.Date.IsZero() {
+		m.Date = time.Now()
+	}
+	if m.MessageID == "" {
+		m.MessageID = NewMessageID(m.From)
+	}
+
+	from, err := m.fromAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	var h headerBuilder
+	h.set("MIME-Version", "1.0")
+	h.set("Date", m.Date.Format(time.RFC1123Z))
+	h.set("Message-ID", m.MessageID)
+	h.text("Subject", m.Subject)
+	h.addressList("From", []*mail.Address{from})
+	h.addresses("To", m.To)
+	h.addresses("Cc", m.Cc)
+	h.addresses("Reply-To", m.ReplyTo)
+	m.threadHeaders(&h)
+
+	// Cabeceras del cliente en orden estable
+	names := make([]string, 0, len(m.Headers))
+	for name := range m.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h.text(textproto.CanonicalMIMEHeaderKey(name), m.Headers[name])
+	}
+
+	if h.err != nil {
+		return nil, h.err
+	}
+
+	m.body().writeTo(&h.buf)
+
+	if m.DKIM != nil {
+		return m.DKIM.Sign(h.buf.Bytes())
+	}
+	return h.buf.Bytes(), nil
+}
+
+// NewMessageID genera un Message-ID único con el dominio del remitente
+// (<id@dominio>).
+func NewMessageID(from string) string {
+	domain := "localhost"
+	if _, after, ok := strings.Cut(envelopeAddress(from), "@"); ok && after != "" {
+		domain = after
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	return fmt.Sprintf("<%d.%x@%s>", time.Now().UnixNano(), id, domain)
+}
+
+// Remitente con el nombre visible de FromName ("Acme Billing <billing@acme.com>")
+func (m *Message) fromAddress() (*mail.Address, error) {
+	addrs, err := parseAddresses("From", []string{m.From})
+	if err != nil {
+		return nil, err
+	}
+
+	from := addrs[0]
+	if m.FromName != "" {
+		from.Name = m.FromName
+	}
+	return from, nil
+}
+
+// In-Reply-To y References para que el cliente agrupe la respuesta en su hilo
+func (m *Message) threadHeaders(h *headerBuilder) {
+	if h.err != nil {
+		return
+	}
+
+	if m.InReplyTo != "" {
+		id, err := formatMessageID("In-Reply-To", m.InReplyTo)
+		if err != nil {
+			h.err = err
+			return
+		}
+		h.set("In-Reply-To", id)
+	}
+
+	if len(m.References) > 0 {
+		refs := make([]string, len(m.References))
+		for i, ref := range m.References {
+			id, err := formatMessageID("References", ref)
+			if err != nil {
+				h.err = err
+				return
+			}
+			refs[i] = id
+		}
+		h.set("References", strings.Join(refs, " "))
+	}
+}
+
+// Arma el árbol MIME del cuerpo
+func (m *Message) body() mimePart {
+	text := m.TextBody
+	if text == "" && m.HtmlBody != "" {
+		text = HTMLToText(m.HtmlBody)
+	}
+
+	// Sin HTML que las referencie, las imágenes inline van como adjuntos normales
+	var inline, attachments []Attachment
+	for _, a := range m.Attachments {
+		if a.ContentID != "" && m.HtmlBody != "" {
+			inline = append(inline, a)
+		} else {
+			attachments = append(attachments, a)
+		}
+	}
+
+	body := textPart("text/plain", text)
+	if m.HtmlBody != "" {
+		html := textPart("text/html", m.HtmlBody)
+		if len(inline) > 0 {
+			parts := []mimePart{html}
+			for _, a := range inline {
+				parts = append(parts, attachmentPart(a))
+			}
+			html = multipartOf("related", parts...)
+			html.header["Content-Type"] += "; type=\"text/html\""
+		}
+		body = multipartOf("alternative", body, html)
+	}
+
+	if len(attachments) > 0 {
+		parts := []mimePart{body}
+		for _, a := range attachments {
+			parts = append(parts, attachmentPart(a))
+		}
+		body = multipartOf("mixed", parts...)
+	}
+
+	return body
+}
+
+// Una entidad MIME: cabeceras de contenido y cuerpo ya codificado
+type mimePart struct {
+	header map[string]string
+	body   []byte
+}
+
+// Las escrituras sobre bytes.Buffer no fallan, así que se ignoran los errores
+func (p mimePart) writeTo(w io.Writer) {
+	keys := make([]string, 0, len(p.header))
+	for k := range p.header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		io.WriteString(w, k+": "+p.header[k]+"\r\n")
+	}
+	io.WriteString(w, "\r\n")
+	w.Write(p.body)
+}
+
+func textPart(mediaType, body string) mimePart {
+	var buf bytes.Buffer
+	qp := quotedprintable.NewWriter(&buf)
+	qp.Write([]byte(body))
+	qp.Close()
+
+	return mimePart{
+		header: map[string]string{
+			"Content-Type":              mediaType + "; charset=UTF-8",
+			"Content-Transfer-Encoding": "quoted-printable",
+		},
+		body: buf.Bytes(),
+	}
+}
+
+func attachmentPart(a Attachment) mimePart {
+	disposition := "attachment"
+	if a.ContentID != "" {
+		disposition = "inline"
+	}
+
+	part := mimePart{
+		header: map[string]string{
+			"Content-Type":              a.contentType(),
+			"Content-Transfer-Encoding": "base64",
+			"Content-Disposition":       mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}),
+		},
+		body: encodeBase64(a.Content),
+	}
+	if a.ContentID != "" {
+		part.header["Content-Id"] = "<" + a.ContentID + ">"
+	}
+	return part
+}
+
+func multipartOf(subtype string, parts ...mimePart) mimePart {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		for k, v := range part.header {
+			header.Set(k, v)
+		}
+
+		w, _ := mw.CreatePart(header)
+		w.Write(part.body)
+	}
+	mw.Close()
+
+	return mimePart{
+		header: map[string]string{
+			"Content-Type": "multipart/" + subtype + "; boundary=\"" + mw.Boundary() + "\"",
+		},
+		body: buf.Bytes(),
+	}
+}
+
+// Base64 en líneas de 76 caracteres (RFC 2045)
+func encodeBase64(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	var buf bytes.Buffer
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n")
+	return buf.Bytes()
+}
+
+// Tipo de contenido del adjunto: el indicado o, si falta, el detectado a
+// partir del contenido y afinado con la extensión del nombre.
+func (a Attachment) contentType() string {
+	if a.ContentType != "" && a.ContentType != "application/octet-stream" {
+		return a.ContentType
+	}
+
+	detected := http.DetectContentType(a.Content)
+	mediaType, _, _ := mime.ParseMediaType(detected)
+	if mediaType == "application/octet-stream" || mediaType == "text/plain" {
+		if byExt := mime.TypeByExtension(filepath.Ext(a.Filename)); byExt != "" {
+			return byExt
+		}
+	}
+	return detected
+}
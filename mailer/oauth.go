@@ -0,0 +1,101 @@
+package mailer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OAuthProvider sabe renovar access tokens de un proveedor OAuth2.
+type OAuthProvider struct {
+	Name         string
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scope        string
+	Server       Server // servidor SMTP del proveedor
+}
+
+// OAuthToken es la respuesta del endpoint de tokens.
+type OAuthToken struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// GoogleOAuth configura el proveedor de Gmail / Google Workspace.
+func GoogleOAuth(clientID, clientSecret string) *OAuthProvider {
+	return &OAuthProvider{
+		Name:         "google",
+		TokenURL:     "https://oauth2.googleapis.com/token",
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Server:       DefaultServer,
+	}
+}
+
+// MicrosoftOAuth configura el proveedor de Microsoft 365 (tenant "common" si se omite).
+func MicrosoftOAuth(tenant, clientID, clientSecret string) *OAuthProvider {
+	if tenant == "" {
+		tenant = "common"
+	}
+
+	return &OAuthProvider{
+		Name:         "microsoft",
+		TokenURL:     "https://login.microsoftonline.com/" + url.PathEscape(tenant) + "/oauth2/v2.0/token",
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scope:        "https://outlook.office.com/SMTP.Send offline_access",
+		Server:       Server{Host: "smtp.office365.com", Port: 587, Security: SecurityStartTLS},
+	}
+}
+
+var oauthClient = &http.Client{Timeout: 10 * time.Second}
+
+// Refresh canjea un refresh token por un access token nuevo. Si el proveedor
+// rota el refresh token, el nuevo viene en OAuthToken.RefreshToken.
+func (p *OAuthProvider) Refresh(ctx context.Context, refreshToken string) (OAuthToken, error) {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+	}
+	if p.Scope != "" {
+		form.Set("scope", p.Scope)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return OAuthToken{}, refreshError(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return OAuthToken{}, refreshError(err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		OAuthToken
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return OAuthToken{}, refreshError(fmt.Errorf("respuesta inválida de %s: %v", p.Name, err))
+	}
+
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return OAuthToken{}, refreshError(fmt.Errorf("%s respondió %d: %s %s", p.Name, resp.StatusCode, body.Error, body.ErrorDescription))
+	}
+	return body.OAuthToken, nil
+}
+
+func refreshError(err error) error {
+	return &Error{Code: CodeOAuthRefresh, Message: "no se pudo renovar el token de acceso", Err: err}
+}
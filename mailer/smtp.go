@@ -0,0 +1,289 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Security indica cómo se protege la conexión con el servidor SMTP.
+type Security string
+
+const (
+	SecurityStartTLS Security = "starttls" // puerto de envío (587) con STARTTLS
+	SecurityTLS      Security = "tls"      // TLS implícito (SMTPS, 465)
+	SecurityPlain    Security = "plain"    // sin cifrado, solo para relays locales
+)
+
+// Server describe el servidor SMTP de una cuenta.
+type Server struct {
+	Host      string    `json:"host"`
+	Port      int       `json:"port"`
+	Security  Security  `json:"security"`
+	TLSPolicy TLSPolicy `json:"tlsPolicy,omitempty"`
+
+	// Mecanismo AUTH fijado; vacío elige el más fuerte que anuncie el servidor
+	AuthMechanism Mechanism `json:"authMechanism,omitempty"`
+}
+
+// DefaultServer es el servidor usado cuando la cuenta no define uno (Gmail).
+var DefaultServer = Server{
+	Host:     "smtp.gmail.com",
+	Port:     587,
+	Security: SecurityStartTLS,
+}
+
+// WithDefaults completa los campos vacíos del servidor. El puerto y el modo
+// de seguridad que haya elegido la cuenta se respetan aunque falte el host.
+func (s Server) WithDefaults() Server {
+	if s.Host == "" {
+		s.Host = DefaultServer.Host
+		if s.Port == 0 && s.Security == "" {
+			s.Port = DefaultServer.Port
+			s.Security = DefaultServer.Security
+		}
+	}
+	if s.Security == "" {
+		s.Security = SecurityStartTLS
+	}
+	if s.Port == 0 {
+		switch s.Security {
+		case SecurityTLS:
+			s.Port = 465
+		case SecurityPlain:
+			s.Port = 25
+		default:
+			s.Port = 587
+		}
+	}
+	if s.TLSPolicy == "" {
+		if s.Security == SecurityPlain {
+			s.TLSPolicy = TLSNone
+		} else {
+			s.TLSPolicy = TLSOpportunistic
+		}
+	}
+	return s
+}
+
+// Validate comprueba que el modo de seguridad y el puerto sean válidos.
+func (s Server) Validate() error {
+	switch s.Security {
+	case "", SecurityStartTLS, SecurityTLS, SecurityPlain:
+	default:
+		return fmt.Errorf("modo de seguridad desconocido: %q", s.Security)
+	}
+
+	if s.Port < 0 || s.Port > 65535 {
+		return fmt.Errorf("puerto inválido: %d", s.Port)
+	}
+
+	if err := s.TLSPolicy.Validate(); err != nil {
+		return err
+	}
+	if err := s.AuthMechanism.Validate(); err != nil {
+		return err
+	}
+	if s.Security == SecurityPlain && s.TLSPolicy == TLSRequire {
+		return fmt.Errorf("la política TLS %q no es compatible con el modo %q", TLSRequire, SecurityPlain)
+	}
+	return nil
+}
+
+func (s Server) addr() string {
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+}
+
+// SMTPTransport envía correos a través del servidor SMTP de la cuenta.
+type SMTPTransport struct {
+	Server Server
+	Login  Login
+	TLS    TLSOptions
+}
+
+// NewSMTPTransport crea el transporte SMTP de una cuenta.
+func NewSMTPTransport(server Server, login Login, tlsOptions TLSOptions) *SMTPTransport {
+	return &SMTPTransport{
+		Server: server.WithDefaults(),
+		Login:  login,
+		TLS:    tlsOptions,
+	}
+}
+
+func (st *SMTPTransport) Send(ctx context.Context, msg *Message) (Result, error) {
+	// El mensaje se arma antes de conectar para no dejar sesiones a medias
+	data, err := msg.Bytes()
+	if err != nil {
+		return Result{}, err
+	}
+
+	c, err := st.dial(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	defer c.Close()
+
+	if err := st.startTLS(c); err != nil {
+		return Result{}, err
+	}
+
+	if ok, advertised := c.Extension("AUTH"); ok {
+		auth, err := st.auth(advertised)
+		if err != nil {
+			return Result{}, err
+		}
+		if auth != nil {
+			if err := c.Auth(auth); err != nil {
+				return Result{}, err
+			}
+		}
+	}
+
+	envelope := msg.Envelope()
+	if err := c.Mail(envelope.From); err != nil {
+		return Result{}, err
+	}
+
+	// Un destinatario rechazado no impide entregar al resto
+	result := Result{MessageID: msg.MessageID}
+	accepted := 0
+	for _, rcpt := range envelope.To {
+		rr := RecipientResult{Address: rcpt, Accepted: true}
+		if err := c.Rcpt(rcpt); err != nil {
+			var smtpErr *textproto.Error
+			if !errors.As(err, &smtpErr) {
+				return result, err
+			}
+			rr = RecipientResult{Address: rcpt, Code: smtpErr.Code, Error: smtpErr.Msg}
+		} else {
+			accepted++
+		}
+		result.Recipients = append(result.Recipients, rr)
+	}
+
+	if accepted == 0 {
+		c.Reset()
+		return result, &Error{Code: CodeRecipientsRejected, Message: "el servidor rechazó a todos los destinatarios", Err: rejection(result.Recipients)}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return result, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return result, err
+	}
+	if err := w.Close(); err != nil {
+		return result, err
+	}
+
+	// El mensaje ya fue aceptado; un fallo en QUIT no debe provocar un reenvío
+	c.Quit()
+	return result, nil
+}
+
+// Resume los rechazos en una sola respuesta SMTP: si alguno fue definitivo
+// (5xx) se usa ese; si todos fueron 4xx (p. ej. greylisting) el envío se
+// puede reintentar.
+func rejection(recipients []RecipientResult) error {
+	var err *textproto.Error
+	for _, rr := range recipients {
+		if err == nil || rr.Code >= 500 {
+			err = &textproto.Error{Code: rr.Code, Msg: rr.Error}
+		}
+		if rr.Code >= 500 {
+			break
+		}
+	}
+	return err
+}
+
+// Elige el mecanismo fijado en la cuenta o, si no hay, el más fuerte de los
+// que el servidor anuncia en EHLO.
+func (st *SMTPTransport) auth(advertised string) (smtp.Auth, error) {
+	candidates := st.Login.mechanisms()
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	offered := strings.Fields(strings.ToUpper(advertised))
+
+	if pinned := st.Server.AuthMechanism; pinned != "" {
+		if !slices.Contains(candidates, pinned) {
+			return nil, &Error{Code: CodeAuthUnsupported, Message: "la cuenta no puede autenticarse con " + string(pinned)}
+		}
+		if !slices.Contains(offered, string(pinned)) {
+			return nil, &Error{Code: CodeAuthUnsupported, Message: "el servidor " + st.Server.Host + " no ofrece AUTH " + string(pinned)}
+		}
+		return st.Login.auth(pinned, st.Server.Host), nil
+	}
+
+	for _, m := range candidates {
+		if slices.Contains(offered, string(m)) {
+			return st.Login.auth(m, st.Server.Host), nil
+		}
+	}
+	return nil, &Error{Code: CodeAuthUnsupported, Message: "el servidor " + st.Server.Host + " no ofrece un mecanismo AUTH compatible"}
+}
+
+// Aplica la política TLS del servidor antes de autenticarse
+func (st *SMTPTransport) startTLS(c *smtp.Client) error {
+	policy := st.Server.TLSPolicy
+
+	if st.Server.Security == SecurityStartTLS && policy != TLSNone {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(st.TLS.config(st.Server.Host)); err != nil {
+				if policy == TLSRequire {
+					return &Error{Code: CodeTLSRequired, Message: "no se pudo establecer STARTTLS", Err: err}
+				}
+				return err
+			}
+		} else if policy == TLSRequire {
+			return &Error{Code: CodeTLSRequired, Message: "el servidor " + st.Server.Host + " no ofrece STARTTLS"}
+		}
+	}
+
+	if _, encrypted := c.TLSConnectionState(); policy == TLSRequire && !encrypted {
+		return &Error{Code: CodeTLSRequired, Message: "la conexión con " + st.Server.Host + " no está cifrada"}
+	}
+	return nil
+}
+
+// Abre la conexión según el modo de seguridad del servidor
+func (st *SMTPTransport) dial(ctx context.Context) (*smtp.Client, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	// Con TLS implícito (SMTPS) el diálogo SMTP ocurre dentro del túnel TLS
+	if st.Server.Security == SecurityTLS {
+		dialer := &tls.Dialer{Config: st.TLS.config(st.Server.Host)}
+		conn, err = dialer.DialContext(ctx, "tcp", st.Server.addr())
+	} else {
+		dialer := &net.Dialer{}
+		conn, err = dialer.DialContext(ctx, "tcp", st.Server.addr())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// El contexto también limita la duración de toda la conversación
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, st.Server.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,560 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testUser     = "user@example.com"
+	testPassword = "secreto"
+)
+
+// Servidor SMTP mínimo en proceso: anuncia lo que se le configure, valida las
+// credenciales de cada mecanismo AUTH y guarda los comandos y los mensajes
+// recibidos.
+type testServer struct {
+	cert     *tls.Config       // certificado del servidor
+	implicit bool              // TLS implícito (SMTPS)
+	startTLS bool              // anuncia STARTTLS
+	auth     string            // mecanismos AUTH anunciados, separados por espacios
+	reject   map[string]string // respuesta a RCPT TO por dirección
+
+	ln   net.Listener
+	mu   sync.Mutex
+	cmds []string
+	data []string
+
+	// Mecanismo con el que se autenticó el cliente y si la conexión ya
+	// estaba cifrada en ese momento
+	mechanism string
+	authTLS   bool
+}
+
+func (s *testServer) start(t *testing.T) Server {
+	t.Helper()
+
+	var err error
+	if s.implicit {
+		s.ln, err = tls.Listen("tcp", "127.0.0.1:0", s.cert)
+	} else {
+		s.ln, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.ln.Close() })
+
+	go func() {
+		for {
+			conn, err := s.ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	server := Server{Host: "127.0.0.1", Port: s.ln.Addr().(*net.TCPAddr).Port, Security: SecurityStartTLS}
+	if s.implicit {
+		server.Security = SecurityTLS
+	}
+	return server
+}
+
+func (s *testServer) commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.cmds...)
+}
+
+func (s *testServer) messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.data...)
+}
+
+func (s *testServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	readLine := func() (string, error) {
+		line, err := r.ReadString('\n')
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	decode := func(line string) string {
+		b, _ := base64.StdEncoding.DecodeString(line)
+		return string(b)
+	}
+
+	encrypted := s.implicit
+	reply("220 test ESMTP")
+	for {
+		line, err := readLine()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.cmds = append(s.cmds, line)
+		s.mu.Unlock()
+
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			reply("250-test")
+			if s.startTLS && !encrypted {
+				reply("250-STARTTLS")
+			}
+			if s.auth != "" {
+				reply("250-AUTH " + s.auth)
+			}
+			reply("250 8BITMIME")
+
+		case "STARTTLS":
+			reply("220 listo")
+			tlsConn := tls.Server(conn, s.cert)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, r, encrypted = tlsConn, bufio.NewReader(tlsConn), true
+
+		case "AUTH":
+			mechanism, initial, _ := strings.Cut(arg, " ")
+			ok := false
+			switch mechanism {
+			case "PLAIN":
+				ok = decode(initial) == "\x00"+testUser+"\x00"+testPassword
+			case "LOGIN":
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+				user, _ := readLine()
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+				password, _ := readLine()
+				ok = decode(user) == testUser && decode(password) == testPassword
+			case "CRAM-MD5":
+				challenge := "<1234.5678@test>"
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte(challenge)))
+				answer, _ := readLine()
+				mac := hmac.New(md5.New, []byte(testPassword))
+				mac.Write([]byte(challenge))
+				ok = decode(answer) == testUser+" "+hex.EncodeToString(mac.Sum(nil))
+			}
+			if !ok {
+				reply("535 credenciales inválidas")
+				continue
+			}
+			s.mu.Lock()
+			s.mechanism, s.authTLS = mechanism, encrypted
+			s.mu.Unlock()
+			reply("235 autenticado")
+
+		case "RCPT":
+			address := strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			if response, ok := s.reject[address]; ok {
+				reply(response)
+				continue
+			}
+			reply("250 ok")
+
+		case "DATA":
+			reply("354 adelante")
+			var body strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				body.WriteString(line)
+			}
+			s.mu.Lock()
+			s.data = append(s.data, body.String())
+			s.mu.Unlock()
+			reply("250 encolado")
+
+		case "QUIT":
+			reply("221 adiós")
+			return
+
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// CA autofirmada para 127.0.0.1. Devuelve la configuración del servidor y la
+// ruta al bundle PEM para LoadTLSOptions.
+func testCertificate(t *testing.T) (*tls.Config, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, caFile
+}
+
+func testMessage() *Message {
+	return &Message{
+		From:     testUser,
+		To:       []string{"ana@example.com"},
+		Subject:  "Prueba",
+		TextBody: "Hola",
+	}
+}
+
+func sendTest(server Server, login Login, tlsOptions TLSOptions) (Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return NewSMTPTransport(server, login, tlsOptions).Send(ctx, testMessage())
+}
+
+func errorCode(err error) string {
+	var mailErr *Error
+	if errors.As(err, &mailErr) {
+		return mailErr.Code
+	}
+	return ""
+}
+
+func TestSMTPImplicitTLS(t *testing.T) {
+	cert, caFile := testCertificate(t)
+	ts := &testServer{cert: cert, implicit: true, auth: "PLAIN"}
+	server := ts.start(t)
+	login := Login{Username: testUser, Password: testPassword}
+
+	t.Run("con el bundle de CAs", func(t *testing.T) {
+		opts, err := LoadTLSOptions("1.2", caFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := sendTest(server, login, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Recipients) != 1 || !result.Recipients[0].Accepted {
+			t.Errorf("destinatarios = %+v", result.Recipients)
+		}
+		if msgs := ts.messages(); len(msgs) != 1 || !strings.Contains(msgs[0], "Subject: Prueba") {
+			t.Errorf("mensajes recibidos = %q", msgs)
+		}
+		if !ts.authTLS {
+			t.Error("AUTH se envió sin cifrar")
+		}
+	})
+
+	t.Run("sin el bundle de CAs", func(t *testing.T) {
+		_, err := sendTest(server, login, TLSOptions{})
+		var certErr *tls.CertificateVerificationError
+		if !errors.As(err, &certErr) {
+			t.Fatalf("err = %v, se esperaba un error de verificación del certificado", err)
+		}
+		if Temporary(err) {
+			t.Error("un certificado inválido no debe reintentarse")
+		}
+	})
+
+	t.Run("versión mínima", func(t *testing.T) {
+		old := &testServer{cert: cert.Clone(), implicit: true}
+		old.cert.MaxVersion = tls.VersionTLS12
+		server := old.start(t)
+
+		opts, err := LoadTLSOptions("1.3", caFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sendTest(server, Login{}, opts); err == nil {
+			t.Fatal("se aceptó TLS 1.2 con mínimo 1.3")
+		}
+		if len(old.messages()) != 0 {
+			t.Error("se envió el mensaje")
+		}
+	})
+}
+
+func TestLoadTLSOptions(t *testing.T) {
+	_, caFile := testCertificate(t)
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(empty, []byte("sin certificados"), 0o600)
+
+	tests := []struct {
+		name       string
+		minVersion string
+		caFile     string
+		want       uint16
+		wantErr    bool
+	}{
+		{name: "por defecto"},
+		{name: "TLS 1.3", minVersion: "1.3", want: tls.VersionTLS13},
+		{name: "con CAs", minVersion: "1.2", caFile: caFile, want: tls.VersionTLS12},
+		{name: "versión desconocida", minVersion: "2.0", wantErr: true},
+		{name: "bundle inexistente", caFile: filepath.Join(t.TempDir(), "no.pem"), wantErr: true},
+		{name: "bundle sin certificados", caFile: empty, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := LoadTLSOptions(tt.minVersion, tt.caFile)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if opts.MinVersion != tt.want {
+				t.Errorf("MinVersion = %x, se esperaba %x", opts.MinVersion, tt.want)
+			}
+			if (opts.RootCAs != nil) != (tt.caFile != "") {
+				t.Errorf("RootCAs = %v", opts.RootCAs)
+			}
+			if cfg := opts.config("smtp.example.com"); cfg.MinVersion < tls.VersionTLS12 {
+				t.Errorf("la configuración acepta TLS %x", cfg.MinVersion)
+			}
+		})
+	}
+}
+
+func TestSMTPStartTLS(t *testing.T) {
+	cert, caFile := testCertificate(t)
+	opts, err := LoadTLSOptions("", caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := Login{Username: testUser, Password: testPassword}
+
+	tests := []struct {
+		name     string
+		startTLS bool
+		policy   TLSPolicy
+		wantCode string // vacío si el envío debe funcionar
+		wantTLS  bool
+	}{
+		{name: "oportunista con STARTTLS", startTLS: true, policy: TLSOpportunistic, wantTLS: true},
+		{name: "oportunista sin STARTTLS", policy: TLSOpportunistic},
+		{name: "obligatorio con STARTTLS", startTLS: true, policy: TLSRequire, wantTLS: true},
+		{name: "obligatorio sin STARTTLS", policy: TLSRequire, wantCode: CodeTLSRequired},
+		{name: "nunca", startTLS: true, policy: TLSNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := &testServer{cert: cert, startTLS: tt.startTLS, auth: "PLAIN"}
+			server := ts.start(t)
+			server.TLSPolicy = tt.policy
+
+			_, err := sendTest(server, login, opts)
+			if code := errorCode(err); code != tt.wantCode || (err != nil && tt.wantCode == "") {
+				t.Fatalf("err = %v, se esperaba el código %q", err, tt.wantCode)
+			}
+
+			if tt.wantCode != "" {
+				// Sin cifrado no se envían credenciales ni el mensaje
+				for _, cmd := range ts.commands() {
+					if strings.HasPrefix(cmd, "AUTH") || strings.HasPrefix(cmd, "MAIL") {
+						t.Errorf("se envió %q sin cifrar", cmd)
+					}
+				}
+				return
+			}
+			if len(ts.messages()) != 1 {
+				t.Fatalf("mensajes recibidos = %d", len(ts.messages()))
+			}
+			if ts.authTLS != tt.wantTLS {
+				t.Errorf("AUTH cifrado = %v, se esperaba %v", ts.authTLS, tt.wantTLS)
+			}
+		})
+	}
+}
+
+func TestSMTPAuthMechanism(t *testing.T) {
+	password := Login{Username: testUser, Password: testPassword}
+
+	tests := []struct {
+		name       string
+		advertised string
+		pinned     Mechanism
+		login      Login
+		want       Mechanism
+		wantCode   string
+	}{
+		{name: "el más fuerte", advertised: "LOGIN PLAIN CRAM-MD5", login: password, want: MechCRAMMD5},
+		{name: "sin CRAM-MD5", advertised: "LOGIN PLAIN", login: password, want: MechPlain},
+		{name: "solo LOGIN", advertised: "LOGIN", login: password, want: MechLogin},
+		{name: "minúsculas", advertised: "login", login: password, want: MechLogin},
+		{name: "fijado", advertised: "LOGIN PLAIN CRAM-MD5", pinned: MechLogin, login: password, want: MechLogin},
+		{name: "fijado sin anunciar", advertised: "PLAIN LOGIN", pinned: MechCRAMMD5, login: password, wantCode: CodeAuthUnsupported},
+		{name: "fijado incompatible", advertised: "XOAUTH2 PLAIN", pinned: MechXOAuth2, login: password, wantCode: CodeAuthUnsupported},
+		{name: "ninguno compatible", advertised: "XOAUTH2 GSSAPI", login: password, wantCode: CodeAuthUnsupported},
+		{name: "sin credenciales", advertised: "PLAIN", login: Login{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := &testServer{auth: tt.advertised}
+			server := ts.start(t)
+			server.Security = SecurityPlain
+			server.AuthMechanism = tt.pinned
+
+			_, err := sendTest(server, tt.login, TLSOptions{})
+			if code := errorCode(err); code != tt.wantCode || (err != nil && tt.wantCode == "") {
+				t.Fatalf("err = %v, se esperaba el código %q", err, tt.wantCode)
+			}
+			if tt.wantCode != "" {
+				if Temporary(err) {
+					t.Error("la falta de un mecanismo compatible no debe reintentarse")
+				}
+				return
+			}
+			if ts.mechanism != string(tt.want) {
+				t.Errorf("mecanismo = %q, se esperaba %q", ts.mechanism, tt.want)
+			}
+		})
+	}
+}
+
+func TestSMTPRecipients(t *testing.T) {
+	reject := map[string]string{
+		"gris@example.com":  "450 4.2.0 greylisting, intente más tarde",
+		"lleno@example.com": "452 4.2.2 buzón lleno",
+		"nadie@example.com": "550 5.1.1 no existe",
+	}
+
+	tests := []struct {
+		name         string
+		to           []string
+		rcptTo       []string
+		wantCode     string   // error de Send
+		wantDeferred []string // destinatarios para reintentar
+		wantRcpt     []string // RCPT TO enviados
+	}{
+		{name: "todos aceptados", to: []string{"ana@example.com"}, wantRcpt: []string{"ana@example.com"}},
+		{
+			name:         "uno diferido",
+			to:           []string{"ana@example.com", "gris@example.com"},
+			wantDeferred: []string{"gris@example.com"},
+			wantRcpt:     []string{"ana@example.com", "gris@example.com"},
+		},
+		{
+			// Los rechazos definitivos no se reintentan
+			name:         "diferido y rechazado",
+			to:           []string{"ana@example.com", "nadie@example.com", "lleno@example.com"},
+			wantDeferred: []string{"lleno@example.com"},
+			wantRcpt:     []string{"ana@example.com", "nadie@example.com", "lleno@example.com"},
+		},
+		{
+			name:     "todos diferidos",
+			to:       []string{"gris@example.com", "lleno@example.com"},
+			wantCode: CodeRecipientsRejected,
+			wantRcpt: []string{"gris@example.com", "lleno@example.com"},
+		},
+		{
+			// El reintento solo va a los diferidos; las cabeceras no cambian
+			name:     "reintento parcial",
+			to:       []string{"ana@example.com", "gris@example.com"},
+			rcptTo:   []string{"gris@example.com"},
+			wantCode: CodeRecipientsRejected,
+			wantRcpt: []string{"gris@example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := &testServer{reject: reject}
+			server := ts.start(t)
+			server.Security = SecurityPlain
+
+			msg := testMessage()
+			msg.To, msg.RcptTo = tt.to, tt.rcptTo
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			result, err := NewSMTPTransport(server, Login{}, TLSOptions{}).Send(ctx, msg)
+			if code := errorCode(err); code != tt.wantCode || (err != nil && tt.wantCode == "") {
+				t.Fatalf("err = %v, se esperaba el código %q", err, tt.wantCode)
+			}
+			if tt.wantCode != "" && !Temporary(err) {
+				t.Error("un rechazo temporal de todos los destinatarios debe reintentarse")
+			}
+
+			var rcpt []string
+			for _, cmd := range ts.commands() {
+				if strings.HasPrefix(cmd, "RCPT TO:") {
+					rcpt = append(rcpt, strings.Trim(strings.TrimPrefix(cmd, "RCPT TO:"), "<>"))
+				}
+			}
+			if strings.Join(rcpt, ",") != strings.Join(tt.wantRcpt, ",") {
+				t.Errorf("RCPT TO = %v, se esperaba %v", rcpt, tt.wantRcpt)
+			}
+			if tt.wantCode != "" {
+				return
+			}
+
+			var deferred []string
+			for _, rr := range result.Deferred() {
+				deferred = append(deferred, rr.Address)
+			}
+			if strings.Join(deferred, ",") != strings.Join(tt.wantDeferred, ",") {
+				t.Errorf("diferidos = %v, se esperaba %v", deferred, tt.wantDeferred)
+			}
+
+			err = result.DeferredError()
+			if len(tt.wantDeferred) == 0 {
+				if err != nil {
+					t.Errorf("DeferredError = %v", err)
+				}
+				return
+			}
+			if errorCode(err) != CodeRecipientsDeferred || !Temporary(err) {
+				t.Errorf("DeferredError = %v, se esperaba un error temporal %q", err, CodeRecipientsDeferred)
+			}
+		})
+	}
+
+	t.Run("cabeceras del reintento", func(t *testing.T) {
+		msg := testMessage()
+		msg.To = []string{"ana@example.com", "gris@example.com"}
+		msg.RcptTo = []string{"gris@example.com"}
+		data, err := msg.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), "ana@example.com") {
+			t.Error("RcptTo cambió las cabeceras del mensaje")
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package mailer
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"io"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// Template es una plantilla de correo guardada por una cuenta. El HTML se
+// renderiza con html/template (escapa las variables según el contexto); el
+// asunto y el texto plano con text/template, porque no son HTML.
+type Template struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Subject   string    `json:"subject"`
+	HtmlBody  string    `json:"htmlBody"`
+	TextBody  string    `json:"textBody,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Rendered es el resultado de aplicar las variables a una plantilla.
+type Rendered struct {
+	Subject  string
+	HtmlBody string
+	TextBody string
+}
+
+// Validate comprueba que la plantilla tenga nombre y cuerpo y que compile.
+func (t Template) Validate() error {
+	if strings.TrimSpace(t.Name) == "" {
+		return &Error{Code: CodeInvalidTemplate, Message: "la plantilla necesita un nombre"}
+	}
+	if t.HtmlBody == "" && t.TextBody == "" {
+		return &Error{Code: CodeInvalidTemplate, Message: "la plantilla necesita htmlBody o textBody"}
+	}
+	_, err := t.parse()
+	return err
+}
+
+// Render aplica las variables a la plantilla. Si falta una variable devuelve
+// un error con el código missing_variable que indica cuál.
+func (t Template) Render(vars map[string]any) (Rendered, error) {
+	p, err := t.parse()
+	if err != nil {
+		return Rendered{}, err
+	}
+	if vars == nil {
+		vars = map[string]any{}
+	}
+
+	var r Rendered
+	if r.Subject, err = execute(p.subject, vars); err != nil {
+		return Rendered{}, err
+	}
+	if r.HtmlBody, err = execute(p.html, vars); err != nil {
+		return Rendered{}, err
+	}
+	if r.TextBody, err = execute(p.text, vars); err != nil {
+		return Rendered{}, err
+	}
+	return r, nil
+}
+
+type parsedTemplate struct {
+	subject, html, text executor
+}
+
+// Lo cumplen tanto text/template como html/template
+type executor interface {
+	Execute(w io.Writer, data any) error
+}
+
+func (t Template) parse() (parsedTemplate, error) {
+	var p parsedTemplate
+
+	subject, err := texttemplate.New("subject").Option("missingkey=error").Parse(t.Subject)
+	if err != nil {
+		return p, &Error{Code: CodeInvalidTemplate, Message: "error en la plantilla del asunto", Err: err}
+	}
+	html, err := htmltemplate.New("htmlBody").Option("missingkey=error").Parse(t.HtmlBody)
+	if err != nil {
+		return p, &Error{Code: CodeInvalidTemplate, Message: "error en la plantilla HTML", Err: err}
+	}
+	text, err := texttemplate.New("textBody").Option("missingkey=error").Parse(t.TextBody)
+	if err != nil {
+		return p, &Error{Code: CodeInvalidTemplate, Message: "error en la plantilla de texto", Err: err}
+	}
+
+	return parsedTemplate{subject: subject, html: html, text: text}, nil
+}
+
+var missingKey = regexp.MustCompile(`map has no entry for key "([^"]*)"`)
+
+func execute(e executor, vars map[string]any) (string, error) {
+	var buf bytes.Buffer
+	if err := e.Execute(&buf, vars); err != nil {
+		if m := missingKey.FindStringSubmatch(err.Error()); m != nil {
+			return "", &Error{Code: CodeMissingVariable, Message: "falta la variable " + m[1]}
+		}
+		return "", &Error{Code: CodeInvalidTemplate, Message: "no se pudo renderizar la plantilla", Err: err}
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,96 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// TLSPolicy define si se puede enviar correo sin cifrar.
+type TLSPolicy string
+
+const (
+	TLSRequire       TLSPolicy = "require"       // falla si la conexión no queda cifrada
+	TLSOpportunistic TLSPolicy = "opportunistic" // usa STARTTLS si el servidor lo ofrece
+	TLSNone          TLSPolicy = "none"          // nunca intenta STARTTLS
+)
+
+var tlsPolicyStrength = map[TLSPolicy]int{
+	TLSNone:          0,
+	TLSOpportunistic: 1,
+	TLSRequire:       2,
+}
+
+// Validate comprueba que la política sea conocida (vacía se acepta).
+func (p TLSPolicy) Validate() error {
+	if _, ok := tlsPolicyStrength[p]; !ok && p != "" {
+		return fmt.Errorf("política TLS desconocida: %q", p)
+	}
+	return nil
+}
+
+// Stricter devuelve la más estricta de las dos políticas, de modo que una
+// solicitud puede endurecer la política guardada pero nunca relajarla.
+func (p TLSPolicy) Stricter(other TLSPolicy) TLSPolicy {
+	if tlsPolicyStrength[other] > tlsPolicyStrength[p] {
+		return other
+	}
+	return p
+}
+
+// TLSOptions ajusta cómo se verifica el TLS del servidor SMTP.
+type TLSOptions struct {
+	MinVersion uint16         // versión mínima aceptada (TLS 1.2 si es 0)
+	RootCAs    *x509.CertPool // CAs propias; nil usa las del sistema
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// LoadTLSOptions construye las opciones a partir de una versión ("1.2", "1.3"...)
+// y de la ruta a un bundle PEM de CAs. Ambos valores son opcionales.
+func LoadTLSOptions(minVersion, caFile string) (TLSOptions, error) {
+	var opts TLSOptions
+
+	if minVersion != "" {
+		version, ok := tlsVersions[minVersion]
+		if !ok {
+			return opts, fmt.Errorf("versión TLS desconocida: %q", minVersion)
+		}
+		opts.MinVersion = version
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return opts, fmt.Errorf("error al leer el bundle de CAs: %v", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return opts, fmt.Errorf("el bundle de CAs %s no contiene certificados", caFile)
+		}
+		opts.RootCAs = pool
+	}
+
+	return opts, nil
+}
+
+// Configuración TLS para conectarse a host
+func (o TLSOptions) config(host string) *tls.Config {
+	minVersion := o.MinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+
+	return &tls.Config{
+		ServerName: host,
+		MinVersion: minVersion,
+		RootCAs:    o.RootCAs,
+	}
+}
@@ -0,0 +1,236 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message es un correo listo para ser entregado por un Transport.
+type Message struct {
+	From     string
+	FromName string // nombre visible del remitente
+	To       []string
+	Cc       []string
+	Bcc      []string // solo en el sobre, nunca en las cabeceras
+	Subject  string
+	HtmlBody string
+	TextBody string // si está vacío se deriva de HtmlBody
+
+	// Respuestas e hilos de conversación
+	ReplyTo    []string
+	InReplyTo  string
+	References []string
+
+	// Cabeceras adicionales (X-*, List-Unsubscribe...); ver CheckCustomHeader
+	Headers map[string]string
+
+	Attachments []Attachment
+
+	// Se generan al armar el mensaje si están vacíos
+	Date      time.Time
+	MessageID string
+
+	// Si está presente el mensaje se firma con DKIM al armarlo
+	DKIM *DKIMSigner
+
+	// Si no está vacío reemplaza a To, Cc y Bcc en el sobre sin cambiar las
+	// cabeceras; sirve para reintentar solo a algunos destinatarios
+	RcptTo []string
+}
+
+// Límites de tamaño de los adjuntos (antes de codificarlos en base64)
+const (
+	MaxAttachmentSize      = 10 << 20
+	MaxTotalAttachmentSize = 20 << 20
+)
+
+// Recipients devuelve las direcciones del sobre (RCPT TO): To, Cc y Bcc sin
+// nombres visibles, o RcptTo si está presente.
+func (m *Message) Recipients() []string {
+	if len(m.RcptTo) > 0 {
+		return m.RcptTo
+	}
+
+	var recipients []string
+	for _, list := range [][]string{m.To, m.Cc, m.Bcc} {
+		for _, rcpt := range list {
+			recipients = append(recipients, envelopeAddress(rcpt))
+		}
+	}
+	return recipients
+}
+
+// Envelope es el remitente y los destinatarios del diálogo SMTP (MAIL FROM y
+// RCPT TO), que no siempre coinciden con las cabeceras (por ejemplo, Bcc).
+type Envelope struct {
+	From string   `json:"from"`
+	To   []string `json:"to"`
+}
+
+func (m *Message) Envelope() Envelope {
+	return Envelope{From: envelopeAddress(m.From), To: m.Recipients()}
+}
+
+// Validate comprueba el mensaje antes de enviarlo: direcciones válidas,
+// cabeceras sin saltos de línea y adjuntos dentro de los límites.
+func (m *Message) Validate() error {
+	if len(m.Recipients()) == 0 {
+		return &Error{Code: CodeNoRecipients, Message: "el mensaje no tiene destinatarios"}
+	}
+
+	if m.From != "" {
+		if _, err := parseAddresses("From", []string{m.From}); err != nil {
+			return err
+		}
+	}
+	for _, field := range []struct {
+		name string
+		list []string
+	}{{"To", m.To}, {"Cc", m.Cc}, {"Bcc", m.Bcc}, {"Reply-To", m.ReplyTo}} {
+		if _, err := parseAddresses(field.name, field.list); err != nil {
+			return err
+		}
+	}
+
+	if err := checkHeaderValue("Subject", m.Subject); err != nil {
+		return err
+	}
+	if err := checkHeaderValue("From", m.FromName); err != nil {
+		return err
+	}
+
+	if m.InReplyTo != "" {
+		if _, err := formatMessageID("In-Reply-To", m.InReplyTo); err != nil {
+			return err
+		}
+	}
+	for _, ref := range m.References {
+		if _, err := formatMessageID("References", ref); err != nil {
+			return err
+		}
+	}
+
+	for name, value := range m.Headers {
+		if err := CheckCustomHeader(name, value); err != nil {
+			return err
+		}
+	}
+
+	total := 0
+	for _, a := range m.Attachments {
+		if a.Filename == "" {
+			return &Error{Code: CodeInvalidAttachment, Message: "los adjuntos necesitan un nombre de archivo"}
+		}
+		if strings.ContainsAny(a.ContentID, "<>\"\\ \t\r\n") {
+			return &Error{Code: CodeInvalidAttachment, Message: fmt.Sprintf("cid inválido: %q", a.ContentID)}
+		}
+		if strings.ContainsAny(a.Filename, "\r\n") {
+			return &Error{Code: CodeInvalidAttachment, Message: fmt.Sprintf("nombre de archivo inválido: %q", a.Filename)}
+		}
+		if a.ContentType != "" {
+			if _, _, err := mime.ParseMediaType(a.ContentType); err != nil || strings.ContainsAny(a.ContentType, "\r\n") {
+				return &Error{Code: CodeInvalidAttachment, Message: fmt.Sprintf("tipo de contenido inválido: %q", a.ContentType)}
+			}
+		}
+		if len(a.Content) > MaxAttachmentSize {
+			return &Error{Code: CodeAttachmentTooLarge, Message: fmt.Sprintf("el adjunto %s supera el máximo de %d MB", a.Filename, MaxAttachmentSize>>20)}
+		}
+		total += len(a.Content)
+	}
+
+	if total > MaxTotalAttachmentSize {
+		return &Error{Code: CodeAttachmentTooLarge, Message: fmt.Sprintf("los adjuntos superan el máximo total de %d MB", MaxTotalAttachmentSize>>20)}
+	}
+	return nil
+}
+
+// Attachment es un archivo adjunto. En JSON el contenido viaja en base64.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType,omitempty"` // se detecta si se omite
+	Content     []byte `json:"content"`
+
+	// Si tiene Content-ID el adjunto va inline y el HTML lo referencia con
+	// <img src="cid:...">
+	ContentID string `json:"cid,omitempty"`
+}
+
+// Result resume lo que el transporte logró entregar.
+type Result struct {
+	MessageID  string
+	Recipients []RecipientResult
+}
+
+// RecipientResult indica si el servidor aceptó a un destinatario.
+type RecipientResult struct {
+	Address  string `json:"address"`
+	Accepted bool   `json:"accepted"`
+	Code     int    `json:"code,omitempty"`  // código SMTP del rechazo
+	Error    string `json:"error,omitempty"` // respuesta del servidor
+}
+
+// Rejected devuelve los destinatarios rechazados.
+func (r Result) Rejected() []RecipientResult {
+	var rejected []RecipientResult
+	for _, rcpt := range r.Recipients {
+		if !rcpt.Accepted {
+			rejected = append(rejected, rcpt)
+		}
+	}
+	return rejected
+}
+
+// Deferred devuelve los destinatarios rechazados con un error temporal (4xx),
+// a los que se puede volver a intentar el envío.
+func (r Result) Deferred() []RecipientResult {
+	var deferred []RecipientResult
+	for _, rcpt := range r.Rejected() {
+		if rcpt.Code >= 400 && rcpt.Code < 500 {
+			deferred = append(deferred, rcpt)
+		}
+	}
+	return deferred
+}
+
+// DeferredError devuelve un error temporal con el código recipients_deferred
+// si el servidor aceptó el mensaje pero difirió a algunos destinatarios, o
+// nil si no difirió a ninguno.
+func (r Result) DeferredError() error {
+	deferred := r.Deferred()
+	if len(deferred) == 0 {
+		return nil
+	}
+	return &Error{Code: CodeRecipientsDeferred, Message: "el servidor rechazó temporalmente a algunos destinatarios", Err: rejection(deferred)}
+}
+
+// Transport entrega un mensaje a través de algún proveedor (SMTP, HTTP, memoria...).
+type Transport interface {
+	Send(ctx context.Context, msg *Message) (Result, error)
+}
+
+// CaptureTransport guarda los mensajes en memoria en lugar de enviarlos.
+// Pensado para pruebas locales.
+type CaptureTransport struct {
+	mu       sync.Mutex
+	Messages []*Message
+}
+
+func (ct *CaptureTransport) Send(ctx context.Context, msg *Message) (Result, error) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if _, err := msg.Bytes(); err != nil {
+		return Result{}, err
+	}
+	ct.Messages = append(ct.Messages, msg)
+
+	result := Result{MessageID: msg.MessageID}
+	for _, rcpt := range msg.Recipients() {
+		result.Recipients = append(result.Recipients, RecipientResult{Address: rcpt, Accepted: true})
+	}
+	return result, nil
+}
@@ -0,0 +1,70 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCaptureTransport(t *testing.T) {
+	var transport Transport = &CaptureTransport{}
+
+	msg := &Message{
+		From:     "billing@acme.com",
+		To:       []string{"Ana <ana@example.com>"},
+		Cc:       []string{"luis@example.com"},
+		Bcc:      []string{"audit@acme.com"},
+		Subject:  "Factura",
+		HtmlBody: "<p>Hola</p>",
+	}
+	result, err := transport.Send(context.Background(), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// El mensaje se arma, así que MessageID queda asignado
+	if result.MessageID == "" || result.MessageID != msg.MessageID {
+		t.Errorf("MessageID = %q, mensaje %q", result.MessageID, msg.MessageID)
+	}
+
+	want := []string{"ana@example.com", "luis@example.com", "audit@acme.com"}
+	if len(result.Recipients) != len(want) {
+		t.Fatalf("destinatarios = %v, se esperaba %v", result.Recipients, want)
+	}
+	for i, rr := range result.Recipients {
+		if rr.Address != want[i] || !rr.Accepted {
+			t.Errorf("destinatario %d = %+v, se esperaba %s aceptado", i, rr, want[i])
+		}
+	}
+	if len(result.Rejected()) != 0 {
+		t.Errorf("rechazados = %v", result.Rejected())
+	}
+
+	captured := transport.(*CaptureTransport).Messages
+	if len(captured) != 1 || captured[0] != msg {
+		t.Fatalf("mensajes capturados = %v", captured)
+	}
+
+	// Bcc va en el sobre pero nunca en las cabeceras
+	data, err := msg.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "audit@acme.com") {
+		t.Error("Bcc aparece en el mensaje")
+	}
+}
+
+func TestCaptureTransportInvalidMessage(t *testing.T) {
+	ct := &CaptureTransport{}
+
+	_, err := ct.Send(context.Background(), &Message{From: "billing@acme.com", Subject: "Sin destinatarios"})
+	var mailErr *Error
+	if !errors.As(err, &mailErr) || mailErr.Code != CodeNoRecipients {
+		t.Fatalf("err = %v, se esperaba %s", err, CodeNoRecipients)
+	}
+	if len(ct.Messages) != 0 {
+		t.Errorf("se capturó un mensaje inválido: %v", ct.Messages)
+	}
+}